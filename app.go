@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	_ "net/http/pprof"
 
@@ -17,49 +19,93 @@ import (
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/jawher/mow.cli"
-	"gopkg.in/mgo.v2"
 )
 
-func parseCollections(mappings string) map[string]CollectionSettings {
+func parseCollections(mappings string, configFile string) map[string]CollectionSettings {
 	idMapping := make(map[string]CollectionSettings)
 	for _, mapping := range strings.Split(mappings, ",") {
-		kv := strings.Split(mapping, ":")
+		kv := strings.SplitN(mapping, ":", 2)
 		if len(kv) != 2 {
 			log.Printf("can't parse id mapping %s, skipping\n", mapping)
+		} else if _, err := parseIDKey(kv[1]); err != nil {
+			log.Printf("can't parse id mapping %s: %v, skipping\n", mapping, err)
 		} else {
 			idMapping[kv[0]] = CollectionSettings{name: kv[0], idPropertyName: kv[1]}
 		}
 	}
 
+	if configFile != "" {
+		if err := readCollectionsConfig(configFile, idMapping); err != nil {
+			panic(err)
+		}
+	}
+
 	log.Printf("collection identifier mappings are:\n")
 	for k, v := range idMapping {
-		log.Printf("%s : %s", k, v)
+		log.Printf("%s : %v", k, v)
 	}
 	return idMapping
 }
 
+// collectionConfig is the configuration file form of a collection's
+// settings.
+type collectionConfig struct {
+	IDProperty string `json:"idProperty"`
+	CollectionSettings
+}
+
+// readCollectionsConfig reads per collection settings from a json file, e.g.
+// {"people": {"idProperty": "uuid", "compression": "zstd"}}. Collections in
+// the file are added to those from the id mapping, and the id property
+// defaults to the mapped one.
+func readCollectionsConfig(path string, collections map[string]CollectionSettings) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var config map[string]collectionConfig
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		return fmt.Errorf("failed to read collections config %s: %v", path, err)
+	}
+
+	for name, c := range config {
+		settings := c.CollectionSettings
+		settings.name = name
+		settings.idPropertyName = c.IDProperty
+		if settings.idPropertyName == "" {
+			settings.idPropertyName = collections[name].idPropertyName
+		}
+		if settings.idPropertyName == "" {
+			return fmt.Errorf("no id property configured for collection %s", name)
+		}
+		if _, err := parseIDKey(settings.idPropertyName); err != nil {
+			return fmt.Errorf("invalid id property for collection %s: %v", name, err)
+		}
+		collections[name] = settings
+	}
+	return nil
+}
+
 func main() {
 
 	app := cli.App("restorage", "A RESTful storage API with pluggable backends")
 	port := app.IntOpt("port", 8080, "Port to listen on")
 	idMap := app.StringOpt("id-map", "test1:uuid,test2:id,...", "Mapping of collection name to identifier property name")
+	collectionsConfig := app.StringOpt("collections-config", "", "json file of per collection settings")
 
 	app.Command("elastic", "use the elastic search backend", func(cmd *cli.Cmd) {
 		url := cmd.StringArg("URL", "", "elastic search endpoint url")
 		indexName := cmd.StringOpt("index-name", "store", "elastic search index name")
 		cmd.Action = func() {
-			client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 30}}
-
-			engs := make(map[string]Engine)
-			for _, c := range parseCollections(*idMap) {
-				e := NewElasticEngine(*url, *indexName, c.name, c.idPropertyName, client)
-				if err := e.Initialise(); err != nil {
-					panic(err)
-				}
-				engs[c.name] = e
+			colls := parseCollections(*idMap, *collectionsConfig)
+			engs, err := elasticEngines(*url, *indexName, colls)
+			if err != nil {
+				panic(err)
 			}
 
-			serve(engs, *port)
+			serve(engs, colls, *port)
 		}
 	})
 
@@ -67,53 +113,219 @@ func main() {
 		hostports := cmd.StringArg("HOSTS", "", "hostname1:port1,hostname2:port2,...")
 		dbname := cmd.StringOpt("dbname", "store", "database name")
 		isBinaryId := cmd.BoolOpt("binary-identity", false, "Is the configured id in a binary format?")
+		binaryIDFormat := cmd.StringOpt("binary-identity-format", "standard", "how binary ids are stored: standard (subtype 4), legacy (subtype 3) or java-legacy (subtype 3 in the java driver's byte order)")
 		cmd.Action = func() {
-			log.Printf("connecting to mongodb '%s'\n", *hostports)
-			s, err := mgo.Dial(*hostports)
+			colls := parseCollections(*idMap, *collectionsConfig)
+			format := ""
+			if *isBinaryId {
+				format = *binaryIDFormat
+			}
+			engs, err := mongoEngines(*hostports, *dbname, format, colls)
 			if err != nil {
 				panic(err)
 			}
-			s.SetMode(mgo.Monotonic, true)
 
-			engs := make(map[string]Engine)
-			for _, c := range parseCollections(*idMap) {
-				e := NewMongoEngine(*dbname, c.name, c.idPropertyName, *isBinaryId, s)
-				if err := e.Initialise(); err != nil {
-					panic(err)
-				}
-				engs[c.name] = e
-			}
-
-			serve(engs, *port)
+			serve(engs, colls, *port)
 		}
 	})
 
 	app.Command("boltdb", "use the boltdb backend", func(cmd *cli.Cmd) {
 		dbdir := cmd.StringArg("DBDIR", "", "directory in which to place db files, one file per collection")
 		unsafe := cmd.BoolOpt("unsafe", false, "don't fsync. This is faster but not safe")
+		codec := cmd.StringOpt("codec", "", "storage codec for new collections: gob, json or msgpack. Defaults to gob, existing collections keep their codec")
+		keyFile := cmd.StringOpt("key-file", "", "file of keys to encrypt stored documents with, one 'id base64key' per line, current key first")
 		cmd.Action = func() {
-			engs := make(map[string]Engine)
-			for _, c := range parseCollections(*idMap) {
-				e, err := NewBoltEngine(*dbdir, c.name, c.idPropertyName, *unsafe)
+			opts := BoltOptions{Unsafe: *unsafe, Codec: *codec, Keys: readKeys(*keyFile)}
+			colls := parseCollections(*idMap, *collectionsConfig)
+			engs, err := boltEngines(*dbdir, opts, colls)
+			if err != nil {
+				panic(err)
+			}
+
+			serve(engs, colls, *port)
+		}
+	})
+
+	app.Command("boltdb-recode", "re-encode boltdb collections with another storage codec", func(cmd *cli.Cmd) {
+		dbdir := cmd.StringArg("DBDIR", "", "directory containing the db files, one file per collection")
+		codec := cmd.StringOpt("codec", "json", "storage codec to re-encode with: gob, json or msgpack")
+		keyFile := cmd.StringOpt("key-file", "", "file of keys to encrypt stored documents with, one 'id base64key' per line, current key first")
+		cmd.Action = func() {
+			keys := readKeys(*keyFile)
+			for _, c := range parseCollections(*idMap, *collectionsConfig) {
+				e, err := NewBoltEngine(*dbdir, c.name, c.idPropertyName, BoltOptions{Compression: c.Compression, Keys: keys, ExpiryProperty: c.expiryProperty()})
+				if err != nil {
+					panic(err)
+				}
+				rc, ok := recoderOf(e)
+				if !ok {
+					panic(fmt.Errorf("collection %s does not support re-encoding", c.name))
+				}
+				log.Printf("re-encoding collection %s with %s\n", c.name, *codec)
+				err = rc.Recode(*codec)
+				e.Close()
 				if err != nil {
 					panic(err)
 				}
-				engs[c.name] = e
 			}
+		}
+	})
 
-			serve(engs, *port)
+	app.Command("mirror", "write to two backends, reading from the primary", func(cmd *cli.Cmd) {
+		primary := cmd.StringOpt("primary", "", "engine to read from and write to first, "+engineSpecHelp)
+		secondary := cmd.StringOpt("secondary", "", "engine to mirror writes to, "+engineSpecHelp)
+		retryInterval := cmd.StringOpt("retry-interval", "10s", "how often to retry writes that failed on the secondary")
+		cmd.Spec = "--primary --secondary [--retry-interval]"
+		cmd.Action = func() {
+			interval, err := time.ParseDuration(*retryInterval)
+			if err != nil {
+				panic(err)
+			}
+			colls := parseCollections(*idMap, *collectionsConfig)
+			primaries, err := openEngines(*primary, colls)
+			if err != nil {
+				panic(err)
+			}
+			secondaries, err := openEngines(*secondary, colls)
+			if err != nil {
+				panic(err)
+			}
+
+			engs := make(map[string]Engine)
+			for name := range colls {
+				engs[name] = NewMirrorEngine(name, primaries[name], secondaries[name], interval)
+			}
+			serve(engs, colls, *port)
+		}
+	})
+
+	app.Command("read-through", "serve a new backend, copying documents across from an old one as they are read", func(cmd *cli.Cmd) {
+		newer := cmd.StringOpt("new", "", "engine to migrate to, "+engineSpecHelp)
+		older := cmd.StringOpt("old", "", "engine to migrate from, "+engineSpecHelp)
+		cmd.Spec = "--new --old"
+		cmd.Action = func() {
+			colls := parseCollections(*idMap, *collectionsConfig)
+			newers, err := openEngines(*newer, colls)
+			if err != nil {
+				panic(err)
+			}
+			olders, err := openEngines(*older, colls)
+			if err != nil {
+				panic(err)
+			}
+
+			engs := make(map[string]Engine)
+			for name := range colls {
+				engs[name] = NewReadThroughEngine(name, newers[name], olders[name])
+			}
+			serve(engs, colls, *port)
 		}
 	})
 
+	dataCommands(app, func() map[string]CollectionSettings {
+		return parseCollections(*idMap, *collectionsConfig)
+	})
+
 	app.Run(os.Args)
 
 }
 
-func serve(engines map[string]Engine, port int) {
-	ah := apiHandlers{engines}
+func readKeys(keyFile string) *keyRing {
+	if keyFile == "" {
+		return nil
+	}
+	keys, err := readKeyFile(keyFile)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+func serve(engines map[string]Engine, collections map[string]CollectionSettings, port int) {
+	ah, err := newAPIHandlers(engines, collections)
+	if err != nil {
+		panic(err)
+	}
+
+	http.Handle("/", handlers.CombinedLoggingHandler(os.Stdout, ah.router()))
+
+	go func() {
+		fmt.Printf("listening on %d\n", port)
+		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+		if err != nil {
+			log.Printf("web server failed: %v\n", err)
+		}
+	}()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+
+	// wait for ctrl-c
+	<-c
+	println("exiting")
+	for _, engine := range ah.engines {
+		engine.Close()
+	}
+
+	return
+}
+
+// newAPIHandlers wraps each engine with the features its collection has
+// configured, and returns the handlers serving them.
+func newAPIHandlers(engines map[string]Engine, collections map[string]CollectionSettings) (*apiHandlers, error) {
+	engines, err := idRulesEngines(engines, collections)
+	if err != nil {
+		return nil, err
+	}
+	if engines, err = derivedIDEngines(engines, collections); err != nil {
+		return nil, err
+	}
+	if engines, err = cachedEngines(engines, collections); err != nil {
+		return nil, err
+	}
+	if engines, err = expiringEngines(engines, collections); err != nil {
+		return nil, err
+	}
+	engines = softDeletingEngines(engines, collections)
+	if engines, err = redirectingEngines(engines, collections); err != nil {
+		return nil, err
+	}
+	schemas, err := newSchemaRegistry(collections)
+	if err != nil {
+		return nil, err
+	}
+	generators, err := idGenerators(collections)
+	if err != nil {
+		return nil, err
+	}
+	return &apiHandlers{engines: engines, schemas: schemas, generators: generators, locks: newKeyedMutex()}, nil
+}
 
+// router returns the API's routes. The fixed /__admin, /__collections and
+// /__batch paths come first, so that they aren't taken for collections.
+func (ah *apiHandlers) router() *mux.Router {
 	m := mux.NewRouter()
-	http.Handle("/", handlers.CombinedLoggingHandler(os.Stdout, m))
+
+	// backup and restore
+	m.HandleFunc("/__admin/backup/{collection}", ah.backupHandler).Methods("GET")
+	m.HandleFunc("/__admin/restore/{collection}", ah.restoreHandler).Methods("POST")
+
+	// compare two collections, and optionally repair the right hand one
+	m.HandleFunc("/__admin/diff", ah.diffHandler).Methods("GET", "POST")
+
+	// writes still waiting to be retried on a mirror's secondary
+	m.HandleFunc("/__admin/mirror/{collection}", ah.mirrorHandler).Methods("GET")
+
+	// re-encode a collection's stored documents while serving
+	m.HandleFunc("/__admin/recode/{collection}", ah.recodeHandler).Methods("POST")
+
+	// the json schema documents in a collection must match
+	m.HandleFunc("/__collections/{collection}/schema", ah.schemaReadHandler).Methods("GET")
+	m.HandleFunc("/__collections/{collection}/schema", ah.schemaWriteHandler).Methods("PUT")
+	m.HandleFunc("/__collections/{collection}/schema", ah.schemaDeleteHandler).Methods("DELETE")
+
+	// put and delete documents together, atomically where possible
+	m.HandleFunc("/__batch", ah.batchHandler).Methods("POST")
 
 	// count
 	m.HandleFunc("/{collection}/__count", ah.countHandler).Methods("GET")
@@ -129,33 +341,43 @@ func serve(engines map[string]Engine, port int) {
 	m.HandleFunc("/{collection}/{id}", ah.idWriteHandler).Methods("PUT")
 	m.HandleFunc("/{collection}/", ah.putAllHandler).Methods("PUT")
 
+	// create with a generated id
+	m.HandleFunc("/{collection}/", ah.createHandler).Methods("POST")
+
 	// delete by id and delete all
 	m.HandleFunc("/{collection}/{id}", ah.idDeleteHandler).Methods("DELETE")
 	m.HandleFunc("/{collection}/", ah.dropHandler).Methods("DELETE")
 
-	go func() {
-		fmt.Printf("listening on %d\n", port)
-		err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-		if err != nil {
-			log.Printf("web server failed: %v\n", err)
-		}
-	}()
+	// restore a soft deleted document
+	m.HandleFunc("/{collection}/{id}/__undelete", ah.undeleteHandler).Methods("POST")
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	// redirect old ids to canonical documents, and list a document's aliases
+	m.HandleFunc("/{collection}/{id}/__redirect", ah.redirectReadHandler).Methods("GET")
+	m.HandleFunc("/{collection}/{id}/__redirect", ah.redirectWriteHandler).Methods("PUT")
+	m.HandleFunc("/{collection}/{id}/__redirect", ah.redirectDeleteHandler).Methods("DELETE")
+	m.HandleFunc("/{collection}/{id}/__aliases", ah.aliasesHandler).Methods("GET")
 
-	// wait for ctrl-c
-	<-c
-	println("exiting")
-	for _, engine := range engines {
-		engine.Close()
-	}
+	// atomically increment fields and change arrays within a document
+	m.HandleFunc("/{collection}/{id}/__ops", ah.opsHandler).Methods("POST")
 
-	return
+	// delete a list of ids, or everything matching a filter
+	m.HandleFunc("/{collection}/__delete", ah.deleteIDsHandler).Methods("POST")
+	m.HandleFunc("/{collection}/__delete_by_query", ah.deleteByQueryHandler).Methods("POST")
+
+	// get, set and remove values within a document by json pointer. These
+	// match any longer path, so must come after the other routes.
+	m.HandleFunc("/{collection}/{id}/{pointer:.+}", ah.pointerReadHandler).Methods("GET")
+	m.HandleFunc("/{collection}/{id}/{pointer:.+}", ah.pointerWriteHandler).Methods("PUT")
+	m.HandleFunc("/{collection}/{id}/{pointer:.+}", ah.pointerDeleteHandler).Methods("DELETE")
+
+	return m
 }
 
 type apiHandlers struct {
-	engines map[string]Engine
+	engines    map[string]Engine
+	schemas    *schemaRegistry
+	generators map[string]*IDGenerator
+	locks      *keyedMutex
 }
 
 func (ah *apiHandlers) idReadHandler(w http.ResponseWriter, r *http.Request) {
@@ -166,19 +388,43 @@ func (ah *apiHandlers) idReadHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if id, err = normaliseID(coll, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	art, found, err := coll.Read(id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 	if !found {
+		if re, ok := redirectEngineOf(coll); ok {
+			target, err := re.resolve(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if target != "" {
+				writeRedirected(w, r, re, vars["collection"], target)
+				return
+			}
+		}
+		if se, ok := softDeleteEngineOf(coll); ok {
+			ts, err := se.readTombstone(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if ts != nil {
+				writeGone(w, id, ts)
+				return
+			}
+		}
 		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(fmt.Sprintf("document with id %s was not found\n", id)))
 		return
 	}
-	w.Header().Add("Content-Type", "application/json")
-	enc := json.NewEncoder(w)
-	enc.Encode(art)
+	writeDocument(w, r, art)
 }
 
 func (ah *apiHandlers) putAllHandler(w http.ResponseWriter, r *http.Request) {
@@ -189,6 +435,24 @@ func (ah *apiHandlers) putAllHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, hasSchema := ah.schemas.get(vars["collection"]); hasSchema {
+		cleanup, err := ah.validateBody(vars["collection"], coll, r)
+		defer cleanup()
+		if ve, ok := err.(*validationError); ok {
+			writeValidationError(w, ve)
+			return
+		} else if err != nil {
+			writeRequestError(w, err)
+			return
+		}
+	}
+
+	dec, err := newRequestDecoder(r)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
 	errCh := make(chan error, 2)
 	docCh := make(chan interface{})
 
@@ -200,9 +464,8 @@ func (ah *apiHandlers) putAllHandler(w http.ResponseWriter, r *http.Request) {
 		defer wg.Done()
 		defer close(docCh)
 
-		dec := json.NewDecoder(r.Body) //TODO: bufio?
 		for {
-			doc, _, err := coll.DecodeJSON(dec)
+			doc, id, err := dec.Decode(coll)
 			if err == io.EOF {
 				return
 			}
@@ -211,6 +474,10 @@ func (ah *apiHandlers) putAllHandler(w http.ResponseWriter, r *http.Request) {
 				log.Printf("failed to decode json. aborting: %v\n", err.Error())
 				return
 			}
+			if err := ah.schemas.validate(vars["collection"], id, doc); err != nil {
+				errCh <- err
+				return
+			}
 			docCh <- doc
 		}
 
@@ -234,6 +501,10 @@ func (ah *apiHandlers) putAllHandler(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case err := <-errCh:
+		if ve, ok := err.(*validationError); ok {
+			writeValidationError(w, ve)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	default:
@@ -252,17 +523,36 @@ func (ah *apiHandlers) idWriteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if id, err = normaliseID(coll, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	doc, docId, err := coll.DecodeJSON(json.NewDecoder(r.Body))
+	doc, docId, err := decodeRequestDocument(coll, r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeRequestError(w, err)
 		return
 	}
 	if docId != id {
 		http.Error(w, "id does not match", http.StatusBadRequest)
 		return
 	}
+	if err := ah.schemas.validate(vars["collection"], id, doc); err != nil {
+		if ve, ok := err.(*validationError); ok {
+			writeValidationError(w, ve)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		if err := setTTL(coll, doc, ttl); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
+	defer ah.locks.lock(vars["collection"] + "/" + id)()
 	err = coll.Write(doc)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("write failed:\n%v\n", err), http.StatusInternalServerError)
@@ -279,8 +569,20 @@ func (ah *apiHandlers) idDeleteHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if id, err = normaliseID(coll, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	deleted, err := coll.Delete(id)
+	var deleted bool
+	if se, ok := softDeleteEngineOf(coll); ok {
+		// soft deletes read the document before replacing it, so hold the
+		// id's lock against PUTs of it
+		defer ah.locks.lock(vars["collection"] + "/" + id)()
+		deleted, err = softDelete(coll, se, id, r.URL.Query().Get("reason"))
+	} else {
+		deleted, err = coll.Delete(id)
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("delete failed:\n%v\n", err), http.StatusInternalServerError)
 		return
@@ -330,16 +632,32 @@ func (ah *apiHandlers) dumpAll(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	enc := json.NewEncoder(w)
-	err = coll.IDs(func(entry rwapi.IDEntry) (bool, error) {
-		doc, found, err := coll.Read(entry.ID)
-		if !found || err != nil {
-			return false, err
+	// engines that can't stream documents natively fall back to reading
+	// each id, optionally with ?parallel=n concurrent readers
+	parallelism := 0
+	if p := r.URL.Query().Get("parallel"); p != "" {
+		parallelism, err = strconv.Atoi(p)
+		if err != nil || parallelism < 1 {
+			http.Error(w, "parallel must be a positive integer", http.StatusBadRequest)
+			return
 		}
+	}
+
+	// documents separated by blank lines, unless the client asks for a
+	// specific format
+	enc, err := newResponseEncoder(w, r, func(w io.Writer) docEncoder {
+		return &streamEncoder{enc: json.NewEncoder(w), w: w, sep: "\n"}
+	})
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	defer enc.Close()
+
+	err = forEachDocument(coll, parallelism, func(doc Document) (bool, error) {
 		if err := enc.Encode(doc); err != nil {
 			return false, err
 		}
-		fmt.Fprint(w, "\n")
 		return true, nil
 	})
 
@@ -355,6 +673,14 @@ func (ah *apiHandlers) dumpAll(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func writeNegotiationError(w http.ResponseWriter, err error) {
+	if err == errNotAcceptable {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 func (ah *apiHandlers) idsHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	coll, err := ah.getCollection(vars["collection"])
@@ -363,10 +689,21 @@ func (ah *apiHandlers) idsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	enc := json.NewEncoder(w)
+	enc, err := newResponseEncoder(w, r, func(w io.Writer) docEncoder {
+		return &streamEncoder{enc: json.NewEncoder(w), w: w}
+	})
+	if err != nil {
+		writeNegotiationError(w, err)
+		return
+	}
+	defer enc.Close()
 
+	// listing what the soft delete engine wraps includes tombstones
+	if se, ok := softDeleteEngineOf(coll); ok && r.URL.Query().Get("includeDeleted") == "true" {
+		coll = se.engine
+	}
 	err = coll.IDs(func(id rwapi.IDEntry) (bool, error) {
-		err := enc.Encode(id)
+		err := enc.Encode(Document{"id": id.ID})
 		if err != nil {
 			return false, err
 		}
@@ -378,6 +715,29 @@ func (ah *apiHandlers) idsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (ah *apiHandlers) recodeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc, ok := recoderOf(coll)
+	if !ok {
+		http.Error(w, "collection does not support re-encoding", http.StatusNotImplemented)
+		return
+	}
+	codecName := r.URL.Query().Get("codec")
+	if _, err := getStorageCodec(codecName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := rc.Recode(codecName); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
 func (ah *apiHandlers) countHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	coll, err := ah.getCollection(vars["collection"])
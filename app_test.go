@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// testAPI serves boltdb collections through the API's routes, wrapped with
+// the features their settings configure.
+type testAPI struct {
+	*apiHandlers
+	router *mux.Router
+}
+
+// testWithAPI runs f against an API serving the collections, each of which
+// must have its name and id property set.
+func testWithAPI(t *testing.T, collections map[string]CollectionSettings, f func(t *testing.T, api *testAPI)) {
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	engines := make(map[string]Engine)
+	for name, c := range collections {
+		be, err := NewBoltEngine(testDir, name, c.idPropertyName, BoltOptions{Unsafe: true, Compression: c.Compression, ExpiryProperty: c.expiryProperty()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines[name] = be
+	}
+	ah, err := newAPIHandlers(engines, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, e := range ah.engines {
+			e.Close()
+		}
+	}()
+
+	f(t, &testAPI{ah, ah.router()})
+}
+
+// do sends a request, with headers given as name, value pairs, and returns
+// the response.
+func (api *testAPI) do(method string, url string, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	api.router.ServeHTTP(w, r)
+	return w
+}
+
+// collectionSettings returns the settings of a collection with the given id
+// property.
+func collectionSettings(name string, idProperty string) CollectionSettings {
+	return CollectionSettings{name: name, idPropertyName: idProperty}
+}
+
+func TestRecodeHandler(t *testing.T) {
+	c := collectionSettings("c", "id")
+	c.CacheSize = 10
+	c.IDRules = &IDRules{Lowercase: true}
+	testWithAPI(t, map[string]CollectionSettings{"c": c}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		assert.NoError(api.engines["c"].Write(Document{"id": "a", "n": 1.0}))
+		// the cache and id rules wrap the boltdb engine, which still recodes
+		w := api.do("POST", "/__admin/recode/c?codec=json", "")
+		assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		w = api.do("POST", "/__admin/recode/c?codec=xml", "")
+		assert.Equal(http.StatusBadRequest, w.Code)
+
+		w = api.do("GET", "/c/A", "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.JSONEq(`{"id":"a","n":1}`, w.Body.String())
+	})
+}
+
+func TestSoftDeleteHandler(t *testing.T) {
+	c := collectionSettings("c", "id")
+	c.SoftDelete = true
+	c.Redirects = "redirect"
+	testWithAPI(t, map[string]CollectionSettings{"c": c}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/1", `{"id":"1"}`).Code)
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/2", `{"id":"2"}`).Code)
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/1/__redirect?replace=true", `{"to":"2"}`).Code)
+
+		// redirects aren't deleted as documents
+		assert.Equal(http.StatusNotFound, api.do("DELETE", "/c/1?reason=merged", "").Code)
+		assert.Equal(http.StatusOK, api.do("GET", "/c/1/__redirect", "").Code)
+		assert.Equal(http.StatusMovedPermanently, api.do("GET", "/c/1", "").Code)
+
+		// soft deletes wait for the id's lock, which PUTs hold too
+		unlock := api.locks.lock("c/2")
+		deleted := make(chan int)
+		go func() {
+			deleted <- api.do("DELETE", "/c/2?reason=duplicate", "").Code
+		}()
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(http.StatusOK, api.do("GET", "/c/2", "").Code)
+		unlock()
+		assert.Equal(http.StatusOK, <-deleted)
+		w := api.do("GET", "/c/2", "")
+		assert.Equal(http.StatusGone, w.Code)
+		assert.Contains(w.Body.String(), "duplicate")
+	})
+}
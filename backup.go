@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Portable backups are newline delimited json. The first line holds a
+// manifest, each document is on a line of its own and the last line records
+// how many documents there were, so that truncated backups can be detected:
+//
+//	{"manifest":{"version":1,"collection":"people","idProperty":"uuid","createdAt":"..."}}
+//	{"document":{"uuid":"...",...}}
+//	{"end":{"count":1}}
+const backupFormatVersion = 1
+
+type backupManifest struct {
+	Version    int       `json:"version"`
+	Collection string    `json:"collection"`
+	IDProperty string    `json:"idProperty"`
+	CreatedAt  time.Time `json:"createdAt"`
+}
+
+type backupEnd struct {
+	Count int `json:"count"`
+}
+
+type backupLine struct {
+	Manifest *backupManifest `json:"manifest,omitempty"`
+	Document Document        `json:"document,omitempty"`
+	End      *backupEnd      `json:"end,omitempty"`
+}
+
+const (
+	backupFormatNDJSON = "ndjson"
+	backupFormatBolt   = "bolt"
+)
+
+// backupHandler streams a consistent backup of a collection. Engines with a
+// native snapshot (boltdb) write that by default, and everything can write
+// the portable format with ?format=ndjson.
+func (ah *apiHandlers) backupHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshotter, canSnapshot := snapshotterOf(coll)
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = backupFormatNDJSON
+		if canSnapshot {
+			format = backupFormatBolt
+		}
+	}
+
+	var out io.Writer = w
+	if acceptsGzip(r) {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	switch {
+	case format == backupFormatBolt && canSnapshot:
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.bolt", vars["collection"]))
+		err = snapshotter.WriteSnapshot(out)
+	case format == backupFormatNDJSON:
+		w.Header().Set("Content-Type", mediaTypeNDJSON)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.ndjson", vars["collection"]))
+		err = writeBackup(out, vars["collection"], coll, nil)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported backup format %s", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		// the response has most likely started, so all we can do is make
+		// sure the backup is incomplete
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func writeBackup(w io.Writer, name string, coll Engine, p *progress) error {
+	enc := json.NewEncoder(w)
+	manifest := backupManifest{
+		Version:    backupFormatVersion,
+		Collection: name,
+		IDProperty: coll.IDPropertyName(),
+		CreatedAt:  time.Now().UTC(),
+	}
+	if err := enc.Encode(backupLine{Manifest: &manifest}); err != nil {
+		return err
+	}
+
+	count := 0
+	err := forEachDocument(coll, 0, func(doc Document) (bool, error) {
+		count++
+		p.add(1)
+		return true, enc.Encode(backupLine{Document: doc})
+	})
+	if err != nil {
+		return err
+	}
+	return enc.Encode(backupLine{End: &backupEnd{Count: count}})
+}
+
+type restoreReport struct {
+	Restored int `json:"restored"`
+}
+
+// restoreHandler loads a backup into a collection, overwriting documents with
+// the same id. Either backup format can be restored into any engine, except
+// that an encrypted bolt snapshot can only be restored into the collection it
+// came from. With ?replace=true the collection is dropped first, once the
+// backup has been checked.
+func (ah *apiHandlers) restoreHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = bufio.NewReader(gz)
+	}
+
+	restored, err := restore(body, coll, r.URL.Query().Get("replace") == "true", nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("restore failed after %d documents: %v", restored, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(restoreReport{Restored: restored})
+}
+
+// restore loads either kind of backup into a collection. With replace the
+// collection is dropped first, but only once the whole backup has been staged
+// and checked, so that a truncated or unreadable backup leaves it as it was.
+func restore(r *bufio.Reader, coll Engine, replace bool, p *progress) (int, error) {
+	if !replace {
+		return writeDocuments(coll, p, func(f func(Document) (bool, error)) error {
+			return readBackup(r, coll, f)
+		})
+	}
+
+	staged, err := ioutil.TempFile("", "restorage-restore")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(staged.Name())
+	defer staged.Close()
+	if _, err := io.Copy(staged, r); err != nil {
+		return 0, err
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	err = readBackup(bufio.NewReader(staged), coll, func(doc Document) (bool, error) {
+		_, _, err := decodeDocument(coll, doc)
+		return err == nil, err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := coll.Drop(); err != nil {
+		return 0, err
+	}
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return restore(bufio.NewReader(staged), coll, false, p)
+}
+
+// readBackup passes each document in either kind of backup to f, failing if
+// the backup turns out to be incomplete.
+func readBackup(r *bufio.Reader, coll Engine, f func(Document) (bool, error)) error {
+	// portable backups start with the manifest object, bolt files don't
+	if first, err := r.Peek(1); err == nil && first[0] == '{' {
+		return readPortableBackup(r, f)
+	}
+	return readBoltBackup(r, coll, f)
+}
+
+func readPortableBackup(r io.Reader, f func(Document) (bool, error)) error {
+	dec := json.NewDecoder(r)
+	var line backupLine
+	if err := dec.Decode(&line); err != nil {
+		return err
+	}
+	if line.Manifest == nil {
+		return errors.New("backup has no manifest")
+	}
+	if line.Manifest.Version != backupFormatVersion {
+		return fmt.Errorf("unsupported backup version %d", line.Manifest.Version)
+	}
+
+	count := 0
+	for {
+		var line backupLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return errors.New("backup is truncated")
+		} else if err != nil {
+			return err
+		}
+		if line.End != nil {
+			if line.End.Count != count {
+				return fmt.Errorf("backup should contain %d documents but had %d", line.End.Count, count)
+			}
+			return nil
+		}
+		count++
+		if more, err := f(line.Document); !more || err != nil {
+			return err
+		}
+	}
+}
+
+func readBoltBackup(r io.Reader, coll Engine, f func(Document) (bool, error)) error {
+	tmp, err := ioutil.TempFile("", "restorage-restore")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	var cipher *valueCipher
+	for _, e := range engineChain(coll) {
+		if be, ok := e.(*boltEngine); ok {
+			cipher = be.cipher
+		}
+	}
+	return readBoltSnapshot(tmp.Name(), cipher, f)
+}
+
+// writeDocuments writes every document produced by the iterate function to
+// the collection, with several concurrent writers. Each document is passed
+// through the engine's DecodeJSON first, as if it had been PUT.
+func writeDocuments(coll Engine, p *progress, iterate func(func(Document) (bool, error)) error) (int, error) {
+	docCh := make(chan interface{})
+	errCh := make(chan error, 8)
+	done := make(chan struct{})
+	var doneOnce sync.Once
+
+	var mu sync.Mutex
+	written := 0
+
+	var wg sync.WaitGroup
+	for x := 0; x < 8; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for doc := range docCh {
+				if err := coll.Write(doc); err != nil {
+					errCh <- err
+					doneOnce.Do(func() { close(done) })
+					return
+				}
+				mu.Lock()
+				written++
+				mu.Unlock()
+				p.add(1)
+			}
+		}()
+	}
+
+	err := iterate(func(doc Document) (bool, error) {
+		decoded, _, err := decodeDocument(coll, doc)
+		if err != nil {
+			return false, err
+		}
+		select {
+		case docCh <- decoded:
+			return true, nil
+		case <-done:
+			return false, nil
+		}
+	})
+	close(docCh)
+	wg.Wait()
+
+	if err == nil {
+		select {
+		case err = <-errCh:
+		default:
+		}
+	}
+	return written, err
+}
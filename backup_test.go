@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackupRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	keyFile := filepath.Join(testDir, "keys")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("k1 "+key+"\n"), 0600))
+	keys, err := readKeyFile(keyFile)
+	assert.NoError(err)
+
+	// an encrypted, compressed and cached collection, a compressed one and a
+	// plain one with another codec
+	options := map[string]BoltOptions{
+		"secret":  {Unsafe: true, Keys: keys, Compression: "snappy"},
+		"small":   {Unsafe: true, Compression: "zstd"},
+		"plain":   {Unsafe: true, Codec: "json"},
+		"another": {Unsafe: true, Keys: keys},
+	}
+	engines := make(map[string]Engine)
+	collections := make(map[string]CollectionSettings)
+	for name, opts := range options {
+		e, err := NewBoltEngine(testDir, name, "id", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		engines[name] = e
+		collections[name] = collectionSettings(name, "id")
+	}
+	secret := collections["secret"]
+	secret.CacheSize = 10
+	collections["secret"] = secret
+	ah, err := newAPIHandlers(engines, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, e := range ah.engines {
+			e.Close()
+		}
+	}()
+	api := &testAPI{ah, ah.router()}
+
+	for i, name := range []string{"1", "2", "3"} {
+		w := api.do("PUT", "/secret/"+name, `{"id":"`+name+`","n":`+name+`}`)
+		assert.Equal(http.StatusOK, w.Code)
+		assert.NoError(api.engines["small"].Write(Document{"id": name, "n": float64(i)}))
+	}
+
+	// the cache doesn't stop the native snapshot being used
+	w := api.do("GET", "/__admin/backup/secret", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("application/octet-stream", w.Header().Get("Content-Type"))
+	snapshot := w.Body.String()
+
+	// a restore replaces what's cached
+	assert.Equal(`{"id":"1","n":1}`+"\n", api.do("GET", "/secret/1", "").Body.String())
+	assert.Equal(http.StatusOK, api.do("PUT", "/secret/1", `{"id":"1","n":10}`).Code)
+	assert.Equal(http.StatusOK, api.do("PUT", "/secret/4", `{"id":"4"}`).Code)
+	w = api.do("POST", "/__admin/restore/secret?replace=true", snapshot)
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(`{"restored":3}`, w.Body.String())
+	assert.Equal(`{"id":"1","n":1}`+"\n", api.do("GET", "/secret/1", "").Body.String())
+	assert.Equal(http.StatusNotFound, api.do("GET", "/secret/4", "").Code)
+
+	// the snapshot is encrypted for the collection it came from
+	w = api.do("POST", "/__admin/restore/another", snapshot)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+
+	// a compressed snapshot restores into a collection with another codec
+	w = api.do("GET", "/__admin/backup/small", "")
+	assert.Equal(http.StatusOK, w.Code)
+	w = api.do("POST", "/__admin/restore/plain", w.Body.String())
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assertSameDocuments(t, api.engines["small"], api.engines["plain"])
+
+	// as does a gzipped portable backup of the encrypted collection
+	w = api.do("GET", "/__admin/backup/secret?format=ndjson", "", "Accept-Encoding", "gzip")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+	w = api.do("POST", "/__admin/restore/plain?replace=true", w.Body.String(), "Content-Encoding", "gzip")
+	assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	assertSameDocuments(t, api.engines["secret"], api.engines["plain"])
+
+	// truncated backups are detected
+	w = api.do("GET", "/__admin/backup/small?format=ndjson", "")
+	lines := bytes.SplitAfter(w.Body.Bytes(), []byte("\n"))
+	truncated := string(bytes.Join(lines[:len(lines)-2], nil))
+	w = api.do("POST", "/__admin/restore/plain", truncated)
+	assert.Equal(http.StatusInternalServerError, w.Code)
+
+	// and leave the collection alone when replacing it, as do backups of
+	// another version and snapshots that don't decrypt
+	before, err := api.engines["plain"].Count()
+	assert.NoError(err)
+	assert.NotZero(before)
+	for _, bad := range []string{
+		truncated,
+		`{"manifest":{"version":2}}` + "\n" + `{"end":{"count":0}}` + "\n",
+		`{"document":{"id":"1"}}` + "\n",
+		snapshot,
+		"not a backup",
+	} {
+		w = api.do("POST", "/__admin/restore/plain?replace=true", bad)
+		assert.Equal(http.StatusInternalServerError, w.Code)
+		count, err := api.engines["plain"].Count()
+		assert.NoError(err)
+		assert.Equal(before, count)
+	}
+}
+
+// assertSameDocuments checks that two collections hold the same documents.
+func assertSameDocuments(t *testing.T, expected Engine, actual Engine) {
+	read := func(coll Engine) map[string]string {
+		docs := make(map[string]string)
+		err := forEachDocument(coll, 0, func(doc Document) (bool, error) {
+			data, err := json.Marshal(doc)
+			docs[doc["id"].(string)] = string(data)
+			return true, err
+		})
+		assert.NoError(t, err)
+		return docs
+	}
+	assert.Equal(t, read(expected), read(actual))
+}
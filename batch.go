@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// BatchOperation is a put or delete of a single document.
+type BatchOperation struct {
+	Delete   bool
+	ID       string
+	Document interface{}
+}
+
+// errBatchUnsupported is returned by Batchers that can't apply a batch
+// atomically, before applying any of it.
+var errBatchUnsupported = errors.New("engine can't apply the batch atomically")
+
+// applyBatch applies a batch atomically if the engine is a Batcher, and
+// otherwise returns errBatchUnsupported. Wrappers that are Batchers forward to
+// it.
+func applyBatch(coll Engine, ops []BatchOperation) ([]bool, error) {
+	if b, ok := coll.(Batcher); ok {
+		return b.ApplyBatch(ops)
+	}
+	return nil, errBatchUnsupported
+}
+
+// batchRequest is the body of a batch request.
+type batchRequest struct {
+	Operations []struct {
+		Op         string          `json:"op"`
+		Collection string          `json:"collection"`
+		ID         string          `json:"id"`
+		Document   json.RawMessage `json:"document"`
+	} `json:"operations"`
+	// RequireAtomic rejects the batch if it can't be applied atomically.
+	RequireAtomic bool `json:"requireAtomic"`
+}
+
+type batchResult struct {
+	Op         string `json:"op"`
+	Collection string `json:"collection"`
+	ID         string `json:"id"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+const (
+	batchStatusWritten  = "written"
+	batchStatusDeleted  = "deleted"
+	batchStatusNotFound = "not found"
+	batchStatusFailed   = "failed"
+	batchStatusSkipped  = "skipped"
+)
+
+type batchResponse struct {
+	// BestEffort is true if the batch wasn't applied atomically, so a
+	// failure may leave earlier operations applied.
+	BestEffort bool          `json:"bestEffort"`
+	Results    []batchResult `json:"results"`
+	// Error is why an atomic batch failed, in which case none of it was
+	// applied.
+	Error string `json:"error,omitempty"`
+}
+
+// batchHandler applies a list of puts and deletes across one or more
+// collections. Every document is decoded and validated before anything is
+// applied. The batch is applied atomically if all its operations are on one
+// collection whose engine can apply it atomically, and otherwise one
+// operation at a time, stopping at the first failure.
+func (ah *apiHandlers) batchHandler(w http.ResponseWriter, r *http.Request) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 {
+		http.Error(w, "empty batch", http.StatusBadRequest)
+		return
+	}
+
+	colls := make(map[string]Engine)
+	ops := make([]BatchOperation, len(req.Operations))
+	results := make([]batchResult, len(req.Operations))
+	for i, op := range req.Operations {
+		coll, err := ah.getCollection(op.Collection)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		colls[op.Collection] = coll
+
+		if ops[i], err = ah.batchOperation(op.Op, op.Collection, coll, op.ID, op.Document); err != nil {
+			if ve, ok := err.(*validationError); ok {
+				writeValidationError(w, ve)
+				return
+			}
+			http.Error(w, fmt.Sprintf("operation %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		results[i] = batchResult{Op: op.Op, Collection: op.Collection, ID: ops[i].ID, Status: batchStatusSkipped}
+	}
+
+	var found []bool
+	err := errBatchUnsupported
+	if len(colls) == 1 {
+		for _, coll := range colls {
+			found, err = applyBatch(coll, ops)
+		}
+	}
+	atomic := err != errBatchUnsupported
+	if !atomic && req.RequireAtomic {
+		http.Error(w, "the batch can't be applied atomically", http.StatusConflict)
+		return
+	}
+
+	resp := batchResponse{BestEffort: !atomic, Results: results}
+	failed := false
+	if atomic {
+		for i := range results {
+			results[i].Status = batchStatus(ops[i], err == nil && found[i], err)
+		}
+		if err != nil {
+			resp.Error = err.Error()
+			failed = true
+		}
+	} else {
+		for i, op := range ops {
+			coll := colls[req.Operations[i].Collection]
+			var found bool
+			var err error
+			if op.Delete {
+				found, err = coll.Delete(op.ID)
+			} else {
+				err = coll.Write(op.Document)
+			}
+			results[i].Status = batchStatus(op, found, err)
+			if err != nil {
+				results[i].Error = err.Error()
+				failed = true
+				break
+			}
+		}
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// batchOperation decodes and checks an operation in a batch request.
+func (ah *apiHandlers) batchOperation(op string, name string, coll Engine, id string, raw json.RawMessage) (BatchOperation, error) {
+	switch op {
+	case "delete":
+		if id == "" {
+			return BatchOperation{}, fmt.Errorf("delete without an id")
+		}
+		id, err := normaliseID(coll, id)
+		return BatchOperation{Delete: true, ID: id}, err
+	case "put":
+		if len(raw) == 0 {
+			return BatchOperation{}, fmt.Errorf("put without a document")
+		}
+		doc, docID, err := coll.DecodeJSON(json.NewDecoder(bytes.NewReader(raw)))
+		if err != nil {
+			return BatchOperation{}, err
+		}
+		if id != "" {
+			if id, err = normaliseID(coll, id); err != nil {
+				return BatchOperation{}, err
+			}
+			if id != docID {
+				return BatchOperation{}, fmt.Errorf("id %s does not match the document's id %s", id, docID)
+			}
+		}
+		if err := ah.schemas.validate(name, docID, doc); err != nil {
+			return BatchOperation{}, err
+		}
+		return BatchOperation{ID: docID, Document: doc}, nil
+	default:
+		return BatchOperation{}, fmt.Errorf("unknown operation %q, expected put or delete", op)
+	}
+}
+
+// batchStatus returns the status of an operation, given whether it found its
+// document and the error applying it.
+func batchStatus(op BatchOperation, found bool, err error) string {
+	switch {
+	case err != nil:
+		return batchStatusFailed
+	case !op.Delete:
+		return batchStatusWritten
+	case found:
+		return batchStatusDeleted
+	default:
+		return batchStatusNotFound
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatchHandler(t *testing.T) {
+	cached := collectionSettings("cached", "id")
+	cached.CacheSize = 10
+	cached.IDRules = &IDRules{Lowercase: true}
+	cached.TTL = "1h"
+	deleting := collectionSettings("deleting", "id")
+	deleting.SoftDelete = true
+	collections := map[string]CollectionSettings{"cached": cached, "deleting": deleting}
+	testWithAPI(t, collections, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		batch := func(body string) (int, batchResponse) {
+			w := api.do("POST", "/__batch", body)
+			var resp batchResponse
+			if w.Code != http.StatusConflict {
+				assert.NoError(json.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+			}
+			return w.Code, resp
+		}
+
+		assert.Equal(http.StatusOK, api.do("PUT", "/cached/a", `{"id":"a","n":1}`).Code)
+		assert.Contains(api.do("GET", "/cached/a", "").Body.String(), `"n":1`)
+
+		// the cache, id rules and expiry don't stop the batch being applied
+		// atomically, and what's cached doesn't outlive it
+		code, resp := batch(`{"requireAtomic":true,"operations":[
+			{"op":"put","collection":"cached","id":"A","document":{"id":"A","n":2}},
+			{"op":"put","collection":"cached","document":{"id":"B"}},
+			{"op":"delete","collection":"cached","id":"C"}
+		]}`)
+		assert.Equal(http.StatusOK, code)
+		assert.False(resp.BestEffort)
+		assert.Equal([]string{"a", "b", "c"}, []string{resp.Results[0].ID, resp.Results[1].ID, resp.Results[2].ID})
+		assert.Equal([]string{batchStatusWritten, batchStatusWritten, batchStatusNotFound},
+			[]string{resp.Results[0].Status, resp.Results[1].Status, resp.Results[2].Status})
+		var doc Document
+		assert.NoError(json.Unmarshal(api.do("GET", "/cached/a", "").Body.Bytes(), &doc))
+		assert.Equal(float64(2), doc["n"])
+		assert.NoError(json.Unmarshal(api.do("GET", "/cached/b", "").Body.Bytes(), &doc))
+		_, expires := expiryTime(doc, defaultExpiryProperty)
+		assert.True(expires)
+
+		// soft deletes can be batched with puts, but deletes are applied one
+		// at a time
+		code, resp = batch(`{"requireAtomic":true,"operations":[
+			{"op":"put","collection":"deleting","document":{"id":"1"}},
+			{"op":"put","collection":"deleting","document":{"id":"2"}}
+		]}`)
+		assert.Equal(http.StatusOK, code)
+		assert.False(resp.BestEffort)
+		deletes := `"operations":[
+			{"op":"delete","collection":"deleting","id":"1"},
+			{"op":"put","collection":"deleting","document":{"id":"3"}}
+		]}`
+		code, _ = batch(`{"requireAtomic":true,` + deletes)
+		assert.Equal(http.StatusConflict, code)
+		assert.Equal(http.StatusOK, api.do("GET", "/deleting/1", "").Code)
+		code, resp = batch(`{` + deletes)
+		assert.Equal(http.StatusOK, code)
+		assert.True(resp.BestEffort)
+		assert.Equal(batchStatusDeleted, resp.Results[0].Status)
+		assert.Equal(http.StatusGone, api.do("GET", "/deleting/1", "").Code)
+		assert.Equal(http.StatusOK, api.do("GET", "/deleting/3", "").Code)
+	})
+}
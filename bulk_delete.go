@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	deleteStatusDeleted  = "deleted"
+	deleteStatusNotFound = "not found"
+	deleteStatusFailed   = "failed"
+)
+
+type deleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type deleteByQueryRequest struct {
+	Filter map[string]interface{} `json:"filter"`
+}
+
+type deleteOutcome struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type deleteReport struct {
+	Deleted  int             `json:"deleted"`
+	NotFound int             `json:"notFound"`
+	Failed   int             `json:"failed"`
+	Results  []deleteOutcome `json:"results"`
+}
+
+// deleteIDsHandler deletes every id listed in a {"ids":[...]} request body
+// and reports the outcome for each of them.
+func (ah *apiHandlers) deleteIDsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req deleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	writeDeleteReport(w, deleteAll(coll, req.IDs))
+}
+
+// deleteByQueryHandler deletes every document matching the filter in a
+// {"filter":{"path":value,...}} request body.
+func (ah *apiHandlers) deleteByQueryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req deleteByQueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Filter) == 0 {
+		http.Error(w, "an empty filter would match every document, use DELETE on the collection instead", http.StatusBadRequest)
+		return
+	}
+
+	ids, err := findIDs(coll, req.Filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeDeleteReport(w, deleteAll(coll, ids))
+}
+
+// findIDs returns the ids of all documents matching the filter, in order.
+// Matching ids are collected before anything is deleted, since some engines
+// can't be written to while an iteration is in progress.
+func findIDs(coll Engine, filter map[string]interface{}) ([]string, error) {
+	var ids []string
+	err := forEachDocument(coll, 8, func(doc Document) (bool, error) {
+		if matchesFilter(doc, filter) {
+			if id, ok := documentID(coll.IDPropertyName(), doc); ok {
+				ids = append(ids, id)
+			}
+		}
+		return true, nil
+	})
+	sort.Strings(ids)
+	return ids, err
+}
+
+func deleteAll(coll Engine, ids []string) deleteReport {
+	results := make([]deleteOutcome, len(ids))
+
+	idxCh := make(chan int)
+	var wg sync.WaitGroup
+	for x := 0; x < 8; x++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idxCh {
+				results[i] = deleteOne(coll, ids[i])
+			}
+		}()
+	}
+	for i := range ids {
+		idxCh <- i
+	}
+	close(idxCh)
+	wg.Wait()
+
+	report := deleteReport{Results: results}
+	for _, res := range results {
+		switch res.Status {
+		case deleteStatusDeleted:
+			report.Deleted++
+		case deleteStatusNotFound:
+			report.NotFound++
+		default:
+			report.Failed++
+		}
+	}
+	return report
+}
+
+func deleteOne(coll Engine, id string) deleteOutcome {
+	deleted, err := coll.Delete(id)
+	switch {
+	case err != nil:
+		return deleteOutcome{ID: id, Status: deleteStatusFailed, Error: err.Error()}
+	case !deleted:
+		return deleteOutcome{ID: id, Status: deleteStatusNotFound}
+	default:
+		return deleteOutcome{ID: id, Status: deleteStatusDeleted}
+	}
+}
+
+func writeDeleteReport(w http.ResponseWriter, report deleteReport) {
+	w.Header().Add("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.Encode(report)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jawher/mow.cli"
+)
+
+const engineSpecHelp = "e.g. boltdb:/data, mongo://host1:27017,host2:27017/dbname or elastic://host:9200/index"
+
+// dataCommands adds the commands that move data in and out of engines
+// directly, without running the server.
+func dataCommands(app *cli.Cli, collections func() map[string]CollectionSettings) {
+	app.Command("export", "export a collection in the portable backup format", func(cmd *cli.Cmd) {
+		from := cmd.StringOpt("from", "", "engine to export from, "+engineSpecHelp)
+		out := cmd.StringOpt("out", "-", "file to write the export to, - for stdout")
+		collection := cmd.StringArg("COLLECTION", "", "collection to export")
+		cmd.Action = func() {
+			engs := mustOpenEngines(*from, collections(), *collection)
+			defer closeEngines(engs)
+
+			w := io.Writer(os.Stdout)
+			if *out != "-" {
+				f, err := os.Create(*out)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				w = f
+			}
+			bw := bufio.NewWriter(w)
+
+			coll := engs[*collection]
+			p := newProgress("exported", *collection, coll)
+			if err := writeBackup(bw, *collection, coll, p); err != nil {
+				log.Fatalf("export failed: %v", err)
+			}
+			if err := bw.Flush(); err != nil {
+				log.Fatalf("export failed: %v", err)
+			}
+			p.done()
+		}
+	})
+
+	app.Command("import", "import a backup or export into a collection", func(cmd *cli.Cmd) {
+		to := cmd.StringOpt("to", "", "engine to import into, "+engineSpecHelp)
+		in := cmd.StringOpt("in", "-", "backup file to import, - for stdin")
+		replace := cmd.BoolOpt("replace", false, "drop the collection before importing")
+		collection := cmd.StringArg("COLLECTION", "", "collection to import into")
+		cmd.Action = func() {
+			engs := mustOpenEngines(*to, collections(), *collection)
+			defer closeEngines(engs)
+
+			r := io.Reader(os.Stdin)
+			if *in != "-" {
+				f, err := os.Open(*in)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+				r = f
+			}
+
+			p := newProgress("imported", *collection, nil)
+			if _, err := restore(bufio.NewReader(r), engs[*collection], *replace, p); err != nil {
+				log.Fatalf("import failed: %v", err)
+			}
+			p.done()
+		}
+	})
+
+	app.Command("copy", "copy collections from one engine to another", func(cmd *cli.Cmd) {
+		from := cmd.StringOpt("from", "", "engine to copy from, "+engineSpecHelp)
+		to := cmd.StringOpt("to", "", "engine to copy to, "+engineSpecHelp)
+		replace := cmd.BoolOpt("replace", false, "drop each destination collection before copying")
+		names := cmd.StringsArg("COLLECTION", nil, "collections to copy, all configured collections if none are given")
+		cmd.Spec = "--from --to [--replace] [COLLECTION...]"
+		cmd.Action = func() {
+			settings := collections()
+			if len(*names) == 0 {
+				for name := range settings {
+					*names = append(*names, name)
+				}
+				sort.Strings(*names)
+			}
+
+			src := mustOpenEngines(*from, settings, *names...)
+			defer closeEngines(src)
+			dst := mustOpenEngines(*to, settings, *names...)
+			defer closeEngines(dst)
+
+			ok := true
+			for _, name := range *names {
+				if err := copyCollection(name, src[name], dst[name], *replace); err != nil {
+					log.Printf("copying %s failed: %v", name, err)
+					ok = false
+				}
+			}
+			if !ok {
+				cli.Exit(1)
+			}
+		}
+	})
+
+	app.Command("diff", "compare collections in two engines", func(cmd *cli.Cmd) {
+		left := cmd.StringOpt("left", "", "left hand engine, "+engineSpecHelp)
+		right := cmd.StringOpt("right", "", "right hand engine, "+engineSpecHelp)
+		plan := cmd.BoolOpt("plan", false, "include the steps that would make the right hand collections match the left")
+		apply := cmd.BoolOpt("apply", false, "make the right hand collections match the left")
+		names := cmd.StringsArg("COLLECTION", nil, "collections to compare, all configured collections if none are given")
+		cmd.Spec = "--left --right [--plan] [--apply] [COLLECTION...]"
+		cmd.Action = func() {
+			settings := collections()
+			if len(*names) == 0 {
+				for name := range settings {
+					*names = append(*names, name)
+				}
+				sort.Strings(*names)
+			}
+
+			l := mustOpenEngines(*left, settings, *names...)
+			defer closeEngines(l)
+			r := mustOpenEngines(*right, settings, *names...)
+			defer closeEngines(r)
+
+			reports := make(map[string]*diffReport)
+			consistent := true
+			for _, name := range *names {
+				report, err := diffCollections(l[name], r[name])
+				if err != nil {
+					log.Fatalf("comparing %s failed: %v", name, err)
+				}
+				if *plan || *apply {
+					report.plan()
+				}
+				if *apply && !report.repair(l[name], r[name]) {
+					log.Printf("some repairs to %s failed", name)
+				}
+				log.Printf("%s: %d missing on left, %d missing on right, %d differing", name, len(report.MissingOnLeft), len(report.MissingOnRight), len(report.Differing))
+				consistent = consistent && report.consistent()
+				reports[name] = report
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(reports)
+			if !consistent && !*apply {
+				cli.Exit(1)
+			}
+		}
+	})
+}
+
+// mustOpenEngines opens the named collections of an engine spec, exiting if
+// they can't be opened.
+func mustOpenEngines(spec string, settings map[string]CollectionSettings, names ...string) map[string]Engine {
+	selected := make(map[string]CollectionSettings)
+	for _, name := range names {
+		c, ok := settings[name]
+		if !ok {
+			log.Fatalf("unknown collection %s, configure it with --id-map or --collections-config", name)
+		}
+		selected[name] = c
+	}
+	engs, err := openEngines(spec, selected)
+	if err != nil {
+		log.Fatalf("failed to open %s: %v", spec, err)
+	}
+	return engs
+}
+
+// copyCollection copies every document from src to dst, then checks that
+// dst has as many documents as src.
+func copyCollection(name string, src Engine, dst Engine, replace bool) error {
+	if replace {
+		if _, err := dst.Drop(); err != nil {
+			return err
+		}
+	}
+
+	p := newProgress("copied", name, src)
+	_, err := writeDocuments(dst, p, func(f func(Document) (bool, error)) error {
+		return forEachDocument(src, 8, f)
+	})
+	if err != nil {
+		return err
+	}
+	p.done()
+
+	srcCount, err := src.Count()
+	if err != nil {
+		return err
+	}
+	dstCount, err := dst.Count()
+	if err != nil {
+		return err
+	}
+	log.Printf("%s: source has %d documents, destination has %d", name, srcCount, dstCount)
+	if srcCount != dstCount {
+		return fmt.Errorf("destination has %d documents but source has %d", dstCount, srcCount)
+	}
+	return nil
+}
+
+// progress logs how many documents have been processed every few seconds.
+// Its methods do nothing on a nil *progress.
+type progress struct {
+	sync.Mutex
+	verb       string
+	collection string
+	total      int
+	count      int
+	start      time.Time
+	lastLog    time.Time
+}
+
+// newProgress starts reporting progress. If coll is given, its count is used
+// as the expected total.
+func newProgress(verb string, collection string, coll Engine) *progress {
+	p := &progress{verb: verb, collection: collection, start: time.Now(), lastLog: time.Now()}
+	if coll != nil {
+		if total, err := coll.Count(); err == nil {
+			p.total = total
+		}
+	}
+	return p
+}
+
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.count += n
+	if time.Since(p.lastLog) >= 5*time.Second {
+		p.lastLog = time.Now()
+		p.log()
+	}
+}
+
+func (p *progress) done() {
+	if p == nil {
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	p.log()
+}
+
+func (p *progress) log() {
+	rate := float64(p.count) / time.Since(p.start).Seconds()
+	if p.total > 0 {
+		log.Printf("%s: %s %d of %d documents (%.0f%%, %.0f/s)", p.collection, p.verb, p.count, p.total, 100*float64(p.count)/float64(p.total), rate)
+	} else {
+		log.Printf("%s: %s %d documents (%.0f/s)", p.collection, p.verb, p.count, rate)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jawher/mow.cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEngineSpec(t *testing.T) {
+	tests := []struct {
+		spec     string
+		scheme   string
+		location string
+		params   url.Values
+	}{
+		{"boltdb:/data", "boltdb", "/data", url.Values{}},
+		{"boltdb:data/dir", "boltdb", "data/dir", url.Values{}},
+		{"boltdb:/data?codec=json&unsafe=true", "boltdb", "/data", url.Values{"codec": {"json"}, "unsafe": {"true"}}},
+		{"mongo://host1:27017,host2:27017/store?binary-identity=true", "mongo", "host1:27017,host2:27017/store", url.Values{"binary-identity": {"true"}}},
+		{"elastic+https://host:9200/index", "elastic+https", "host:9200/index", url.Values{}},
+	}
+	for _, test := range tests {
+		scheme, location, params, err := parseEngineSpec(test.spec)
+		assert.NoError(t, err, test.spec)
+		assert.Equal(t, test.scheme, scheme, test.spec)
+		assert.Equal(t, test.location, location, test.spec)
+		assert.Equal(t, test.params, params, test.spec)
+	}
+
+	for _, spec := range []string{"", "boltdb", ":/data", "boltdb:", "boltdb:?codec=json", "mongo://", "boltdb:/data?codec=%zz"} {
+		_, _, _, err := parseEngineSpec(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestSplitLocation(t *testing.T) {
+	tests := []struct {
+		location string
+		host     string
+		name     string
+	}{
+		{"host:27017", "host:27017", ""},
+		{"host:27017/", "host:27017", ""},
+		{"host1:27017,host2:27017/store", "host1:27017,host2:27017", "store"},
+		{"host:9200/index/", "host:9200", "index"},
+	}
+	for _, test := range tests {
+		host, name := splitLocation(test.location)
+		assert.Equal(t, test.host, host, test.location)
+		assert.Equal(t, test.name, name, test.location)
+	}
+}
+
+func TestOpenEngines(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-spec-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	collections := map[string]CollectionSettings{
+		"a": collectionSettings("a", "id"),
+		"b": collectionSettings("b", "uuid"),
+	}
+	engs, err := openEngines("boltdb:"+testDir+"?codec=json&unsafe=true", collections)
+	assert.NoError(err)
+	assert.Len(engs, 2)
+	assert.Equal("uuid", engs["b"].IDPropertyName())
+	assert.NoError(engs["a"].Write(Document{"id": "1"}))
+	closeEngines(engs)
+
+	for _, spec := range []string{
+		"redis://host:6379",
+		"boltdb:" + testDir + "?unsafe=maybe",
+		"boltdb:" + testDir + "?codec=xml",
+		"boltdb:" + testDir + "?key-file=" + filepath.Join(testDir, "missing"),
+		"mongo://host:27017/store?binary-identity=perhaps",
+	} {
+		_, err := openEngines(spec, collections)
+		assert.Error(err, spec)
+	}
+}
+
+func TestDataCommands(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-cli-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	collections := func() map[string]CollectionSettings {
+		return map[string]CollectionSettings{
+			"a": collectionSettings("a", "id"),
+			"b": collectionSettings("b", "id"),
+		}
+	}
+	run := func(args ...string) {
+		app := cli.App("restorage", "")
+		dataCommands(app, collections)
+		assert.NoError(app.Run(append([]string{"restorage"}, args...)))
+	}
+	dir := func(name string) string {
+		return "boltdb:" + filepath.Join(testDir, name) + "?unsafe=true"
+	}
+	write := func(spec string, name string, docs ...Document) {
+		engs, err := openEngines(spec, map[string]CollectionSettings{name: collections()[name]})
+		assert.NoError(err)
+		defer closeEngines(engs)
+		for _, doc := range docs {
+			assert.NoError(engs[name].Write(doc))
+		}
+	}
+	count := func(spec string, name string) int {
+		engs, err := openEngines(spec, map[string]CollectionSettings{name: collections()[name]})
+		assert.NoError(err)
+		defer closeEngines(engs)
+		n, err := engs[name].Count()
+		assert.NoError(err)
+		return n
+	}
+
+	write(dir("src"), "a", Document{"id": "1"}, Document{"id": "2"})
+	write(dir("src"), "b", Document{"id": "3"})
+
+	export := filepath.Join(testDir, "a.ndjson")
+	run("export", "--from="+dir("src"), "--out="+export, "a")
+	run("import", "--to="+dir("imported"), "--in="+export, "a")
+	assert.Equal(2, count(dir("imported"), "a"))
+
+	// copies every configured collection if none are named
+	run("copy", "--from="+dir("src"), "--to="+dir("copied"))
+	assert.Equal(2, count(dir("copied"), "a"))
+	assert.Equal(1, count(dir("copied"), "b"))
+
+	write(dir("copied"), "a", Document{"id": "4"})
+	run("diff", "--left="+dir("src"), "--right="+dir("copied"), "--apply", "a")
+	assert.Equal(2, count(dir("copied"), "a"))
+
+	write(dir("imported"), "a", Document{"id": "5"})
+	run("import", "--to="+dir("imported"), "--in="+export, "--replace", "a")
+	assert.Equal(2, count(dir("imported"), "a"))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Transformed values, such as compressed ones, start with envelopeMarker
+// followed by a byte identifying the transformation. None of the storage
+// codecs produce a leading zero byte, so plain and transformed values can live
+// side by side and compression can be switched on or off for a collection at
+// any time.
+const envelopeMarker = 0x00
+
+const (
+	compressionSnappy byte = 0x01
+	compressionZstd   byte = 0x02
+)
+
+var compressionAlgorithms = map[string]byte{
+	"snappy": compressionSnappy,
+	"zstd":   compressionZstd,
+}
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// checkCompression returns an error if the named compression algorithm isn't
+// supported. An empty name means no compression.
+func checkCompression(name string) error {
+	if name == "" {
+		return nil
+	}
+	if _, ok := compressionAlgorithms[name]; !ok {
+		return fmt.Errorf("unknown compression %s", name)
+	}
+	return nil
+}
+
+// compress compresses data with the named algorithm, or returns it unchanged
+// if the name is empty.
+func compress(name string, data []byte) ([]byte, error) {
+	if name == "" {
+		return data, nil
+	}
+	algorithm, ok := compressionAlgorithms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %s", name)
+	}
+
+	out := []byte{envelopeMarker, algorithm}
+	switch algorithm {
+	case compressionSnappy:
+		return append(out, snappy.Encode(nil, data)...), nil
+	default:
+		return zstdEncoder.EncodeAll(data, out), nil
+	}
+}
+
+// isCompressed reports whether data was produced by compress.
+func isCompressed(data []byte) bool {
+	return len(data) > 1 && data[0] == envelopeMarker && (data[1] == compressionSnappy || data[1] == compressionZstd)
+}
+
+// decompress reverses compress, returning uncompressed data unchanged.
+func decompress(data []byte) ([]byte, error) {
+	if !isCompressed(data) {
+		return data, nil
+	}
+	if data[1] == compressionSnappy {
+		return snappy.Decode(nil, data[2:])
+	}
+	return zstdDecoder.DecodeAll(data[2:], nil)
+}
@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"io"
+	"time"
 
 	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 )
@@ -25,4 +28,128 @@ type Document map[string]interface{}
 type CollectionSettings struct {
 	name           string
 	idPropertyName string
+
+	// Compression is the algorithm stored documents are compressed with:
+	// snappy, zstd or empty for none. The boltdb engine compresses whole
+	// documents, mongodb only fields larger than CompressionThreshold bytes.
+	Compression          string `json:"compression"`
+	CompressionThreshold int    `json:"compressionThreshold"`
+
+	// CacheSize is how many recently read documents to keep in memory, none
+	// if zero. CacheTTL, e.g. "5m", limits how long each is kept.
+	CacheSize int    `json:"cacheSize"`
+	CacheTTL  string `json:"cacheTTL"`
+
+	// ExpiryProperty holds the time, in RFC 3339 format, after which a
+	// document is deleted. TTL, e.g. "24h", gives documents written without
+	// one an expiry time, and defaults ExpiryProperty to "expiresAt".
+	ExpiryProperty string `json:"expiryProperty"`
+	TTL            string `json:"ttl"`
+
+	// SoftDelete replaces deleted documents with tombstones, from which they
+	// can be undeleted.
+	SoftDelete bool `json:"softDelete"`
+
+	// Schema is a JSON schema that documents written to the collection must
+	// match.
+	Schema json.RawMessage `json:"schema"`
+
+	// IDRules, if set, constrain and normalise the collection's ids.
+	IDRules *IDRules `json:"idRules"`
+
+	// IDGenerator configures how ids are generated for documents POSTed to
+	// the collection. Random uuids are generated if it isn't set.
+	IDGenerator *IDGenerator `json:"idGenerator"`
+
+	// DerivedID, if set, derives the collection's ids from a source
+	// identifier in each document.
+	DerivedID *DerivedID `json:"derivedId"`
+
+	// Redirects, if set, lets old ids redirect to canonical documents. It's
+	// "redirect" to respond to reads of old ids with redirects, or "serve"
+	// to serve the canonical documents.
+	Redirects string `json:"redirects"`
+}
+
+// DocumentIterator is implemented by engines that can stream whole documents
+// natively, rather than needing a Read for every id.
+type DocumentIterator interface {
+	Documents(f func(Document) (bool, error)) error
+}
+
+// Recoder is implemented by engines that can re-encode their stored documents
+// with another storage codec.
+type Recoder interface {
+	Recode(codecName string) error
+}
+
+// Snapshotter is implemented by engines that can write a consistent copy of
+// their native storage, which is restored with the engine's own tools.
+type Snapshotter interface {
+	WriteSnapshot(w io.Writer) error
+}
+
+// Expirer is implemented by engines that can find and delete expired
+// documents natively.
+type Expirer interface {
+	DeleteExpired(property string, now time.Time) (int, error)
+}
+
+// Updater is implemented by engines that can apply operations to a document
+// atomically, creating it if it doesn't exist. It returns the changed
+// document, and whether it was created. Engines that can't apply the
+// operations natively return errUpdateUnsupported, and errors caused by the
+// operations themselves are *opsErrors.
+type Updater interface {
+	Update(id string, ops *Operations) (Document, bool, error)
+}
+
+// Batcher is implemented by engines that can apply a batch of puts and deletes
+// atomically. It returns, for each operation, whether the document was found,
+// which only matters for deletes. Engines that can't apply a batch atomically
+// return errBatchUnsupported without applying any of it.
+type Batcher interface {
+	ApplyBatch(ops []BatchOperation) ([]bool, error)
+}
+
+// Wrapper is implemented by engines that add behaviour, such as caching, to
+// another engine.
+type Wrapper interface {
+	Unwrap() Engine
+}
+
+// engineChain returns an engine followed by each engine it wraps, so that
+// handlers can find the wrapper providing a feature.
+func engineChain(coll Engine) []Engine {
+	chain := []Engine{coll}
+	for {
+		w, ok := coll.(Wrapper)
+		if !ok {
+			return chain
+		}
+		coll = w.Unwrap()
+		chain = append(chain, coll)
+	}
+}
+
+// recoderOf returns the engine within a collection's wrappers that can
+// re-encode its stored documents, if there is one.
+func recoderOf(coll Engine) (Recoder, bool) {
+	for _, e := range engineChain(coll) {
+		if rc, ok := e.(Recoder); ok {
+			return rc, true
+		}
+	}
+	return nil, false
+}
+
+// snapshotterOf returns the engine within a collection's wrappers that can
+// snapshot its native storage, if there is one.
+func snapshotterOf(coll Engine) (Snapshotter, bool) {
+	for _, e := range engineChain(coll) {
+		if s, ok := e.(Snapshotter); ok {
+			return s, true
+		}
+	}
+	return nil, false
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const (
+	repairPut    = "put"
+	repairDelete = "delete"
+)
+
+// diffReport describes how the right hand collection differs from the left.
+type diffReport struct {
+	LeftCount      int          `json:"leftCount"`
+	RightCount     int          `json:"rightCount"`
+	MissingOnLeft  []string     `json:"missingOnLeft"`
+	MissingOnRight []string     `json:"missingOnRight"`
+	Differing      []string     `json:"differing"`
+	Repair         []repairStep `json:"repair,omitempty"`
+}
+
+// repairStep is one step in making the right hand collection match the left:
+// either putting the left document or deleting the right one. Once applied,
+// Error records any failure.
+type repairStep struct {
+	Op    string `json:"op"`
+	ID    string `json:"id"`
+	Error string `json:"error,omitempty"`
+}
+
+func (dr *diffReport) consistent() bool {
+	return len(dr.MissingOnLeft) == 0 && len(dr.MissingOnRight) == 0 && len(dr.Differing) == 0
+}
+
+// diffCollections compares two collections by id and content hash.
+func diffCollections(left Engine, right Engine) (*diffReport, error) {
+	leftHashes, err := hashDocuments(left)
+	if err != nil {
+		return nil, fmt.Errorf("reading left: %v", err)
+	}
+	rightHashes, err := hashDocuments(right)
+	if err != nil {
+		return nil, fmt.Errorf("reading right: %v", err)
+	}
+
+	report := &diffReport{
+		LeftCount:      len(leftHashes),
+		RightCount:     len(rightHashes),
+		MissingOnLeft:  []string{},
+		MissingOnRight: []string{},
+		Differing:      []string{},
+	}
+	for id, lh := range leftHashes {
+		rh, found := rightHashes[id]
+		switch {
+		case !found:
+			report.MissingOnRight = append(report.MissingOnRight, id)
+		case rh != lh:
+			report.Differing = append(report.Differing, id)
+		}
+	}
+	for id := range rightHashes {
+		if _, found := leftHashes[id]; !found {
+			report.MissingOnLeft = append(report.MissingOnLeft, id)
+		}
+	}
+	sort.Strings(report.MissingOnLeft)
+	sort.Strings(report.MissingOnRight)
+	sort.Strings(report.Differing)
+	return report, nil
+}
+
+// hashDocuments returns the sha256 of each document's canonical json, which
+// encoding/json produces since it sorts map keys.
+func hashDocuments(coll Engine) (map[string][sha256.Size]byte, error) {
+	hashes := make(map[string][sha256.Size]byte)
+	var mu sync.Mutex
+	err := forEachDocument(coll, 8, func(doc Document) (bool, error) {
+		id, ok := documentID(coll.IDPropertyName(), doc)
+		if !ok {
+			return false, fmt.Errorf("document without a valid %s id", coll.IDPropertyName())
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return false, err
+		}
+		mu.Lock()
+		hashes[id] = sha256.Sum256(data)
+		mu.Unlock()
+		return true, nil
+	})
+	return hashes, err
+}
+
+// plan fills in the steps that would make the right collection match the
+// left.
+func (dr *diffReport) plan() {
+	dr.Repair = []repairStep{}
+	for _, id := range dr.MissingOnRight {
+		dr.Repair = append(dr.Repair, repairStep{Op: repairPut, ID: id})
+	}
+	for _, id := range dr.Differing {
+		dr.Repair = append(dr.Repair, repairStep{Op: repairPut, ID: id})
+	}
+	for _, id := range dr.MissingOnLeft {
+		dr.Repair = append(dr.Repair, repairStep{Op: repairDelete, ID: id})
+	}
+}
+
+// repair applies the planned steps, recording any that fail. It returns
+// false if any did.
+func (dr *diffReport) repair(left Engine, right Engine) bool {
+	ok := true
+	for i, step := range dr.Repair {
+		var err error
+		switch step.Op {
+		case repairPut:
+			err = copyDocument(left, right, step.ID)
+		case repairDelete:
+			_, err = right.Delete(step.ID)
+		}
+		if err != nil {
+			dr.Repair[i].Error = err.Error()
+			ok = false
+		}
+	}
+	return ok
+}
+
+func copyDocument(src Engine, dst Engine, id string) error {
+	doc, found, err := src.Read(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s no longer exists", id)
+	}
+	decoded, _, err := decodeDocument(dst, doc.(Document))
+	if err != nil {
+		return err
+	}
+	return dst.Write(decoded)
+}
+
+// diffHandler compares the collections named by the left and right query
+// parameters. A GET only reports differences, adding a repair plan with
+// ?plan=true, while a POST also applies the repair plan to the right hand
+// collection.
+func (ah *apiHandlers) diffHandler(w http.ResponseWriter, r *http.Request) {
+	left, err := ah.getCollection(r.URL.Query().Get("left"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	right, err := ah.getCollection(r.URL.Query().Get("right"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if left.IDPropertyName() != right.IDPropertyName() {
+		http.Error(w, "collections have different id properties", http.StatusBadRequest)
+		return
+	}
+
+	report, err := diffCollections(left, right)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" || r.URL.Query().Get("plan") == "true" {
+		report.plan()
+	}
+	if r.Method == "POST" && !report.repair(left, right) {
+		status = http.StatusInternalServerError
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
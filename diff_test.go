@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffCollections(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, left Engine) {
+		testWithBolt(t, func(t *testing.T, right Engine) {
+			assert := assert.New(t)
+
+			assert.NoError(left.Write(Document{"id": "1", "n": 1.0}))
+			assert.NoError(left.Write(Document{"id": "2", "n": 2.0}))
+			assert.NoError(left.Write(Document{"id": "3", "n": 3.0}))
+			assert.NoError(right.Write(Document{"id": "2", "n": 2.0}))
+			assert.NoError(right.Write(Document{"id": "3", "n": 4.0}))
+			assert.NoError(right.Write(Document{"id": "4", "n": 4.0}))
+
+			report, err := diffCollections(left, right)
+			assert.NoError(err)
+			assert.Equal(3, report.LeftCount)
+			assert.Equal(3, report.RightCount)
+			assert.Equal([]string{"4"}, report.MissingOnLeft)
+			assert.Equal([]string{"1"}, report.MissingOnRight)
+			assert.Equal([]string{"3"}, report.Differing)
+			assert.False(report.consistent())
+
+			report.plan()
+			assert.Equal([]repairStep{
+				{Op: repairPut, ID: "1"},
+				{Op: repairPut, ID: "3"},
+				{Op: repairDelete, ID: "4"},
+			}, report.Repair)
+			assert.True(report.repair(left, right))
+
+			report, err = diffCollections(left, right)
+			assert.NoError(err)
+			assert.True(report.consistent())
+		})
+	})
+}
+
+func TestDiffHandler(t *testing.T) {
+	collections := map[string]CollectionSettings{
+		"left":  collectionSettings("left", "id"),
+		"right": collectionSettings("right", "id"),
+		"other": collectionSettings("other", "uuid"),
+	}
+	testWithAPI(t, collections, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		assert.NoError(api.engines["left"].Write(Document{"id": "1"}))
+		assert.NoError(api.engines["left"].Write(Document{"id": "2"}))
+		assert.NoError(api.engines["right"].Write(Document{"id": "2", "changed": true}))
+		assert.NoError(api.engines["right"].Write(Document{"id": "3"}))
+
+		// a GET only reports
+		w := api.do("GET", "/__admin/diff?left=left&right=right&plan=true", "")
+		assert.Equal(http.StatusOK, w.Code)
+		var report diffReport
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &report))
+		assert.Equal([]string{"1"}, report.MissingOnRight)
+		assert.Equal([]string{"2"}, report.Differing)
+		assert.Equal([]string{"3"}, report.MissingOnLeft)
+		assert.Len(report.Repair, 3)
+		_, found, err := api.engines["right"].Read("1")
+		assert.NoError(err)
+		assert.False(found)
+
+		// a POST repairs the right hand collection
+		w = api.do("POST", "/__admin/diff?left=left&right=right", "")
+		assert.Equal(http.StatusOK, w.Code)
+		w = api.do("GET", "/__admin/diff?left=left&right=right", "")
+		assert.Equal(http.StatusOK, w.Code)
+		report = diffReport{}
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &report))
+		assert.True(report.consistent())
+		assert.Nil(report.Repair)
+
+		w = api.do("GET", "/__admin/diff?left=left&right=missing", "")
+		assert.Equal(http.StatusBadRequest, w.Code)
+		w = api.do("GET", "/__admin/diff?left=left&right=other", "")
+		assert.Equal(http.StatusBadRequest, w.Code)
+	})
+}
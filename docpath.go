@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// lookupPath resolves a dotted path such as "meta.uuid" or "aliases.0"
+// against a document. Numeric path segments index into arrays.
+func lookupPath(doc map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = doc
+	for _, segment := range strings.Split(path, ".") {
+		switch v := current.(type) {
+		case Document:
+			next, ok := v[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case map[string]interface{}:
+			next, ok := v[segment]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			current = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// matchesFilter reports whether every path in filter resolves to an equal
+// value in doc. As in mongodb, a filter value matches an array if it is equal
+// to any of its elements.
+func matchesFilter(doc Document, filter map[string]interface{}) bool {
+	for path, want := range filter {
+		got, found := lookupPath(doc, path)
+		if !found {
+			return false
+		}
+		if valuesEqual(got, want) {
+			continue
+		}
+		arr, ok := got.([]interface{})
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, elem := range arr {
+			if valuesEqual(elem, want) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesEqual compares two document values, treating all numeric types as
+// equal when their values are, since engines don't agree on number types.
+func valuesEqual(a, b interface{}) bool {
+	if af, ok := toFloat(a); ok {
+		bf, ok := toFloat(b)
+		return ok && af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	default:
+		return 0, false
+	}
+}
+
+// setPath sets the value at a dotted path, creating intermediate objects as
+// needed.
+func setPath(doc map[string]interface{}, path string, value interface{}) {
+	segments := strings.Split(path, ".")
+	current := doc
+	for _, segment := range segments[:len(segments)-1] {
+		next, ok := asObject(current[segment])
+		if !ok {
+			next = make(map[string]interface{})
+			current[segment] = next
+		}
+		current = next
+	}
+	current[segments[len(segments)-1]] = value
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+)
+
+// forEachDocument calls f for every document in the collection until f
+// returns false or an error. Engines that implement DocumentIterator stream
+// their documents natively. For the others each id is read in turn or, if
+// parallelism is greater than one, by that many concurrent readers, in which
+// case documents are passed to f in no particular order.
+func forEachDocument(coll Engine, parallelism int, f func(Document) (bool, error)) error {
+	if it, ok := coll.(DocumentIterator); ok {
+		return it.Documents(f)
+	}
+	if parallelism > 1 {
+		return parallelDocuments(coll, parallelism, f)
+	}
+	return coll.IDs(func(entry rwapi.IDEntry) (bool, error) {
+		doc, found, err := coll.Read(entry.ID)
+		if err != nil {
+			return false, err
+		}
+		if !found {
+			// deleted since it was listed
+			return true, nil
+		}
+		return f(doc.(Document))
+	})
+}
+
+func parallelDocuments(coll Engine, parallelism int, f func(Document) (bool, error)) error {
+	idCh := make(chan string)
+	docCh := make(chan Document)
+	errCh := make(chan error, parallelism+1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(idCh)
+		err := coll.IDs(func(entry rwapi.IDEntry) (bool, error) {
+			select {
+			case idCh <- entry.ID:
+				return true, nil
+			case <-done:
+				return false, nil
+			}
+		})
+		if err != nil {
+			errCh <- err
+		}
+	}()
+
+	readersDone := make(chan struct{})
+	for x := 0; x < parallelism; x++ {
+		go func() {
+			defer func() { readersDone <- struct{}{} }()
+			for id := range idCh {
+				doc, found, err := coll.Read(id)
+				if err != nil {
+					errCh <- err
+					return
+				}
+				if !found {
+					continue
+				}
+				select {
+				case docCh <- doc.(Document):
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		for x := 0; x < parallelism; x++ {
+			<-readersDone
+		}
+		close(docCh)
+	}()
+
+	defer func() {
+		close(done)
+		// unblock the readers so that they and the IDs iteration can finish
+		for range docCh {
+		}
+	}()
+
+	for {
+		select {
+		case err := <-errCh:
+			return err
+		case doc, ok := <-docCh:
+			if !ok {
+				select {
+				case err := <-errCh:
+					return err
+				default:
+					return nil
+				}
+			}
+			more, err := f(doc)
+			if err != nil || !more {
+				return err
+			}
+		}
+	}
+}
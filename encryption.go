@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// envelopeEncrypted follows envelopeMarker in encrypted values, which are laid
+// out as marker, kind, key id length, key id, nonce and then the AES-GCM
+// sealed value.
+const envelopeEncrypted byte = 0x10
+
+// keyRing holds the master keys read from a key file. The first key encrypts
+// new values, and every key can decrypt values written with it.
+type keyRing struct {
+	current string
+	keys    map[string][]byte
+}
+
+// readKeyFile reads a key file with one key per line, as a key id followed by
+// the base64 encoded 32 byte key, e.g. "2019-01 c2VjcmV0...". Blank lines and
+// lines starting with # are ignored. To rotate keys, add a new key at the top
+// of the file and re-encode the collections.
+func readKeyFile(path string) (*keyRing, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	kr := &keyRing{keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) > 255 {
+			return nil, fmt.Errorf("can't parse key file line %q", line)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key %s must be 32 base64 encoded bytes", fields[0])
+		}
+		if _, ok := kr.keys[fields[0]]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", fields[0])
+		}
+		if kr.current == "" {
+			kr.current = fields[0]
+		}
+		kr.keys[fields[0]] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if kr.current == "" {
+		return nil, fmt.Errorf("no keys found in %s", path)
+	}
+	return kr, nil
+}
+
+// valueCipher encrypts the values of one collection. Each master key is used
+// to derive a separate key for every collection.
+type valueCipher struct {
+	collection string
+	current    string
+	aeads      map[string]cipher.AEAD
+}
+
+func (kr *keyRing) forCollection(collection string) (*valueCipher, error) {
+	vc := &valueCipher{collection: collection, current: kr.current, aeads: make(map[string]cipher.AEAD)}
+	for id, master := range kr.keys {
+		mac := hmac.New(sha256.New, master)
+		mac.Write([]byte("restorage collection key:" + collection))
+		block, err := aes.NewCipher(mac.Sum(nil))
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		vc.aeads[id] = aead
+	}
+	return vc, nil
+}
+
+// additionalData binds an encrypted value to its collection and id, so that
+// values can't be swapped between documents.
+func (vc *valueCipher) additionalData(id []byte) []byte {
+	return append([]byte(vc.collection+"\x00"), id...)
+}
+
+func (vc *valueCipher) encrypt(id []byte, data []byte) ([]byte, error) {
+	aead := vc.aeads[vc.current]
+	out := append([]byte{envelopeMarker, envelopeEncrypted, byte(len(vc.current))}, vc.current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, vc.additionalData(id)), nil
+}
+
+func isEncrypted(data []byte) bool {
+	return len(data) > 2 && data[0] == envelopeMarker && data[1] == envelopeEncrypted
+}
+
+func (vc *valueCipher) decrypt(id []byte, data []byte) ([]byte, error) {
+	keyIDLen := int(data[2])
+	if len(data) < 3+keyIDLen {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	keyID := string(data[3 : 3+keyIDLen])
+	aead, ok := vc.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("value is encrypted with unknown key %s", keyID)
+	}
+	data = data[3+keyIDLen:]
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], vc.additionalData(id))
+}
@@ -1,63 +1,222 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 	"github.com/boltdb/bolt"
 )
 
+// errStopIteration is returned from bolt ForEach callbacks to stop early. It
+// is never returned to callers.
+var errStopIteration = errors.New("iteration stopped")
+
+var (
+	// boltMetaBucket holds settings that apply to the whole file, such as
+	// the codec its documents are stored with.
+	boltMetaBucket = []byte("__restorage_meta")
+	boltCodecKey   = []byte("codec")
+
+	// boltExpiryBucket indexes documents by expiry time, with keys of the
+	// big endian unix nanosecond time followed by the id, and
+	// boltExpiryIDsBucket maps ids back to their expiry time.
+	boltExpiryBucket    = []byte("__restorage_expiry")
+	boltExpiryIDsBucket = []byte("__restorage_expiry_ids")
+)
+
+// boltInternalPrefix starts the names of buckets that don't hold documents.
+const boltInternalPrefix = "__restorage_"
+
+// boltDefaultCodec is used for new collections when no codec is configured,
+// and for files written before the codec was recorded.
+const boltDefaultCodec = "gob"
+
 type boltEngine struct {
 	db             *bolt.DB
 	collectionName []byte
 	idPropertyName string
+	compression    string
+	cipher         *valueCipher
+	expiryProperty string
 }
 
-func init() {
-	gob.Register([]interface{}{})
-	gob.Register(map[string]interface{}{})
+// BoltOptions configure how a bolt engine stores documents.
+type BoltOptions struct {
+	// Unsafe disables fsync. This is faster but not safe.
+	Unsafe bool
+	// Codec is the name of the storage codec for new collections. Existing
+	// collections keep the codec recorded in their metadata, so this must
+	// either be empty or match it.
+	Codec string
+	// Compression is the algorithm documents are compressed with when
+	// written: snappy, zstd or empty for none. Documents already stored
+	// are read whatever their compression.
+	Compression string
+	// Keys, if set, encrypt every document written. Documents already stored
+	// unencrypted remain readable.
+	Keys *keyRing
+	// ExpiryProperty, if set, is indexed so that expired documents can be
+	// found without reading every document.
+	ExpiryProperty string
 }
 
-func NewBoltEngine(datadir string, collectionName string, idPropertyName string, unsafe bool) (Engine, error) {
+func NewBoltEngine(datadir string, collectionName string, idPropertyName string, opts BoltOptions) (Engine, error) {
 
 	if err := os.MkdirAll(datadir, 0700); err != nil {
 		return nil, err
 	}
 
+	if err := checkCompression(opts.Compression); err != nil {
+		return nil, err
+	}
+	if _, err := parseIDKey(idPropertyName); err != nil {
+		return nil, err
+	}
+
 	db, err := bolt.Open(filepath.Join(datadir, collectionName), 0600, &bolt.Options{Timeout: 1 * time.Second})
 	if err != nil {
 		return nil, err
 	}
 
-	db.NoSync = unsafe
+	db.NoSync = opts.Unsafe
 
 	if err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(collectionName))
-		return err
+		b, err := tx.CreateBucketIfNotExists([]byte(collectionName))
+		if err != nil {
+			return err
+		}
+		return initBoltCodec(tx, collectionName, b, opts.Codec)
 	}); err != nil {
+		db.Close()
 		return nil, err
 	}
 
 	e := &boltEngine{
-		db, []byte(collectionName), idPropertyName,
+		db, []byte(collectionName), idPropertyName, opts.Compression, nil, opts.ExpiryProperty,
+	}
+	if opts.Keys != nil {
+		if e.cipher, err = opts.Keys.forCollection(collectionName); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if e.expiryProperty != "" {
+		if err := db.Update(e.initExpiryIndex); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
 	return e, nil
 }
 
+// initBoltCodec records the codec for a collection that doesn't have one yet,
+// and checks that any configured codec matches the one already recorded.
+func initBoltCodec(tx *bolt.Tx, collectionName string, b *bolt.Bucket, configured string) error {
+	meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+	if err != nil {
+		return err
+	}
+
+	if recorded := meta.Get(boltCodecKey); recorded != nil {
+		if configured != "" && configured != string(recorded) {
+			return fmt.Errorf("collection %s is stored with codec %s, not %s. Use the boltdb-recode command to change it", collectionName, recorded, configured)
+		}
+		return nil
+	}
+
+	name := configured
+	if name == "" || b.Stats().KeyN > 0 {
+		// existing data predates codec metadata, so must be gob
+		if configured != "" && configured != boltDefaultCodec {
+			return fmt.Errorf("collection %s is stored with codec %s, not %s. Use the boltdb-recode command to change it", collectionName, boltDefaultCodec, configured)
+		}
+		name = boltDefaultCodec
+	}
+	if _, err := getStorageCodec(name); err != nil {
+		return err
+	}
+	return meta.Put(boltCodecKey, []byte(name))
+}
+
+// codec returns the codec recorded for the collection. Reading it within the
+// transaction keeps every transaction consistent with any concurrent Recode.
+func (ee *boltEngine) codec(tx *bolt.Tx) (storageCodec, error) {
+	name := boltDefaultCodec
+	if meta := tx.Bucket(boltMetaBucket); meta != nil {
+		if recorded := meta.Get(boltCodecKey); recorded != nil {
+			name = string(recorded)
+		}
+	}
+	return getStorageCodec(name)
+}
+
 func (ee *boltEngine) Drop() (bool, error) {
 	err := ee.db.Update(func(tx *bolt.Tx) error {
-		return tx.DeleteBucket(ee.collectionName)
+		if err := tx.DeleteBucket(ee.collectionName); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(ee.collectionName); err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltExpiryBucket, boltExpiryIDsBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		if ee.expiryProperty != "" {
+			return ee.initExpiryIndex(tx)
+		}
+		return nil
 	})
 	return true, err // FIXME:
 }
 
+// Recode re-encodes every document with the named codec and the current
+// compression and key, in a single transaction so readers stay consistent.
+func (ee *boltEngine) Recode(codecName string) error {
+	to, err := getStorageCodec(codecName)
+	if err != nil {
+		return err
+	}
+	return ee.db.Update(func(tx *bolt.Tx) error {
+		from, err := ee.codec(tx)
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(ee.collectionName)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			doc, err := ee.unwrap(from, k, v)
+			if err != nil {
+				return fmt.Errorf("failed to decode %s: %v", k, err)
+			}
+			data, err := ee.wrap(to, k, doc)
+			if err != nil {
+				return fmt.Errorf("failed to encode %s: %v", k, err)
+			}
+			// replacing the value of the current key doesn't move the cursor
+			if err := b.Put(k, data); err != nil {
+				return err
+			}
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(boltMetaBucket)
+		if err != nil {
+			return err
+		}
+		return meta.Put(boltCodecKey, []byte(to.Name()))
+	})
+}
+
 func (ee *boltEngine) Write(resource interface{}) error {
 	doc := resource.(Document)
 	id, err := ee.getID(doc)
@@ -65,30 +224,64 @@ func (ee *boltEngine) Write(resource interface{}) error {
 		return err
 	}
 	return ee.db.Batch(func(tx *bolt.Tx) error {
-		return tx.Bucket(ee.collectionName).Put(id, ee.ser(doc))
+		data, err := ee.ser(tx, id, doc)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(ee.collectionName).Put(id, data); err != nil {
+			return err
+		}
+		return ee.indexExpiry(tx, id, doc)
 	})
 }
 
-func (ee *boltEngine) deser(data []byte) (Document, error) {
-	var doc Document
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	err := dec.Decode(&doc)
+func (ee *boltEngine) deser(tx *bolt.Tx, id []byte, data []byte) (Document, error) {
+	c, err := ee.codec(tx)
+	if err != nil {
+		return nil, err
+	}
+	return ee.unwrap(c, id, data)
+}
+
+func (ee *boltEngine) ser(tx *bolt.Tx, id []byte, doc Document) ([]byte, error) {
+	c, err := ee.codec(tx)
 	if err != nil {
 		return nil, err
 	}
-	return doc, nil
+	return ee.wrap(c, id, doc)
 }
 
-func (ee *boltEngine) ser(doc Document) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(doc)
+// wrap encodes, compresses and encrypts a document for storage.
+func (ee *boltEngine) wrap(c storageCodec, id []byte, doc Document) ([]byte, error) {
+	data, err := c.Marshal(doc)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	bytes := buf.Bytes()
+	if data, err = compress(ee.compression, data); err != nil {
+		return nil, err
+	}
+	if ee.cipher != nil {
+		return ee.cipher.encrypt(id, data)
+	}
+	return data, nil
+}
 
-	return bytes
+// unwrap reverses wrap.
+func (ee *boltEngine) unwrap(c storageCodec, id []byte, data []byte) (Document, error) {
+	if isEncrypted(data) {
+		if ee.cipher == nil {
+			return nil, errors.New("document is encrypted but no keys are configured")
+		}
+		var err error
+		if data, err = ee.cipher.decrypt(id, data); err != nil {
+			return nil, err
+		}
+	}
+	data, err := decompress(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.Unmarshal(data)
 }
 
 func (ee *boltEngine) Delete(id string) (bool, error) {
@@ -101,11 +294,175 @@ func (ee *boltEngine) Delete(id string) (bool, error) {
 			return nil
 		}
 		found = true
-		return tx.Bucket(ee.collectionName).Delete(id)
+		if err := tx.Bucket(ee.collectionName).Delete(id); err != nil {
+			return err
+		}
+		return ee.unindexExpiry(tx, id)
 	})
 	return found, err
 }
 
+// ApplyBatch applies puts and deletes within a single transaction.
+func (ee *boltEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	found := make([]bool, len(ops))
+	err := ee.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ee.collectionName)
+		for i, op := range ops {
+			key := []byte(op.ID)
+			if op.Delete {
+				if found[i] = b.Get(key) != nil; !found[i] {
+					continue
+				}
+				if err := b.Delete(key); err != nil {
+					return err
+				}
+				if err := ee.unindexExpiry(tx, key); err != nil {
+					return err
+				}
+				continue
+			}
+			doc := op.Document.(Document)
+			data, err := ee.ser(tx, key, doc)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+			if err := ee.indexExpiry(tx, key, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Update applies operations to a document within a single transaction.
+func (ee *boltEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	var doc Document
+	var created bool
+	err := ee.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(id)
+		current := tx.Bucket(ee.collectionName).Get(key)
+		if current == nil {
+			created = true
+			doc = Document{}
+			if err := setDocumentID(ee.idPropertyName, doc, id); err != nil {
+				return err
+			}
+		} else {
+			var err error
+			if doc, err = ee.deser(tx, key, current); err != nil {
+				return err
+			}
+		}
+		if err := ops.apply(doc, created); err != nil {
+			return &opsError{err}
+		}
+		data, err := ee.ser(tx, key, doc)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(ee.collectionName).Put(key, data); err != nil {
+			return err
+		}
+		return ee.indexExpiry(tx, key, doc)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return doc, created, nil
+}
+
+// initExpiryIndex creates the expiry index, indexing any documents already
+// stored, if the file doesn't have one yet.
+func (ee *boltEngine) initExpiryIndex(tx *bolt.Tx) error {
+	if tx.Bucket(boltExpiryBucket) != nil {
+		return nil
+	}
+	if _, err := tx.CreateBucket(boltExpiryBucket); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket(boltExpiryIDsBucket); err != nil {
+		return err
+	}
+	return tx.Bucket(ee.collectionName).ForEach(func(k []byte, v []byte) error {
+		doc, err := ee.deser(tx, k, v)
+		if err != nil {
+			return err
+		}
+		return ee.indexExpiry(tx, k, doc)
+	})
+}
+
+// indexExpiry replaces a document's entry in the expiry index.
+func (ee *boltEngine) indexExpiry(tx *bolt.Tx, id []byte, doc Document) error {
+	if ee.expiryProperty == "" {
+		return nil
+	}
+	if err := ee.unindexExpiry(tx, id); err != nil {
+		return err
+	}
+	t, ok := expiryTime(doc, ee.expiryProperty)
+	if !ok {
+		return nil
+	}
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	key = append(key, id...)
+	if err := tx.Bucket(boltExpiryBucket).Put(key, []byte{}); err != nil {
+		return err
+	}
+	return tx.Bucket(boltExpiryIDsBucket).Put(id, key[:8])
+}
+
+func (ee *boltEngine) unindexExpiry(tx *bolt.Tx, id []byte) error {
+	ids := tx.Bucket(boltExpiryIDsBucket)
+	if ids == nil {
+		return nil
+	}
+	t := ids.Get(id)
+	if t == nil {
+		return nil
+	}
+	key := append(append([]byte{}, t...), id...)
+	if err := tx.Bucket(boltExpiryBucket).Delete(key); err != nil {
+		return err
+	}
+	return ids.Delete(id)
+}
+
+// DeleteExpired deletes the documents that expired by now, using the expiry
+// index rather than reading every document.
+func (ee *boltEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	if ee.expiryProperty != property {
+		return 0, fmt.Errorf("expiry index is on %q, not %q", ee.expiryProperty, property)
+	}
+	deleted := 0
+	err := ee.db.Update(func(tx *bolt.Tx) error {
+		var ids [][]byte
+		c := tx.Bucket(boltExpiryBucket).Cursor()
+		for k, _ := c.First(); k != nil && int64(binary.BigEndian.Uint64(k)) <= now.UnixNano(); k, _ = c.Next() {
+			ids = append(ids, append([]byte{}, k[8:]...))
+		}
+		for _, id := range ids {
+			if err := tx.Bucket(ee.collectionName).Delete(id); err != nil {
+				return err
+			}
+			if err := ee.unindexExpiry(tx, id); err != nil {
+				return err
+			}
+		}
+		deleted = len(ids)
+		return nil
+	})
+	return deleted, err
+}
+
 func (ee *boltEngine) Count() (int, error) {
 	count := 0
 	err := ee.db.View(func(tx *bolt.Tx) error {
@@ -116,16 +473,18 @@ func (ee *boltEngine) Count() (int, error) {
 }
 
 func (ee *boltEngine) Read(id string) (interface{}, bool, error) {
-	var result []byte
+	var doc Document
 	err := ee.db.View(func(tx *bolt.Tx) error {
-		result = tx.Bucket(ee.collectionName).Get([]byte(id))
-		return nil
+		// the value is only valid for the life of the transaction
+		result := tx.Bucket(ee.collectionName).Get([]byte(id))
+		if result == nil {
+			return nil
+		}
+		var err error
+		doc, err = ee.deser(tx, []byte(id), result)
+		return err
 	})
-	if result == nil {
-		return nil, false, err
-	}
-	doc, err := ee.deser(result)
-	if err != nil {
+	if doc == nil || err != nil {
 		return nil, false, err
 	}
 	return doc, true, nil
@@ -133,18 +492,83 @@ func (ee *boltEngine) Read(id string) (interface{}, bool, error) {
 }
 
 func (ee boltEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
-	return ee.db.View(func(tx *bolt.Tx) error {
+	err := ee.db.View(func(tx *bolt.Tx) error {
 		return tx.Bucket(ee.collectionName).ForEach(func(k []byte, v []byte) error {
 			more, err := f(rwapi.IDEntry{ID: string(k)})
 			if err != nil {
 				return err
 			}
 			if !more {
-				return errors.New("aborted")
+				return errStopIteration
+			}
+			return nil
+		})
+	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+func (ee boltEngine) Documents(f func(Document) (bool, error)) error {
+	err := ee.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(ee.collectionName).ForEach(func(k []byte, v []byte) error {
+			doc, err := ee.deser(tx, k, v)
+			if err != nil {
+				return err
+			}
+			more, err := f(doc)
+			if err != nil {
+				return err
+			}
+			if !more {
+				return errStopIteration
 			}
 			return nil
 		})
 	})
+	if err == errStopIteration {
+		return nil
+	}
+	return err
+}
+
+// WriteSnapshot writes a consistent copy of the whole db file.
+func (ee boltEngine) WriteSnapshot(w io.Writer) error {
+	return ee.db.View(func(tx *bolt.Tx) error {
+		_, err := tx.WriteTo(w)
+		return err
+	})
+}
+
+// readBoltSnapshot calls f for each document in a db file written by
+// WriteSnapshot. Encrypted documents can only be read with the cipher of the
+// collection they were written by.
+func readBoltSnapshot(path string, cipher *valueCipher, f func(Document) (bool, error)) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var names [][]byte
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if !strings.HasPrefix(string(name), boltInternalPrefix) {
+				names = append(names, append([]byte{}, name...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(names) != 1 {
+		return fmt.Errorf("expected one collection in snapshot, found %d", len(names))
+	}
+
+	src := &boltEngine{db: db, collectionName: names[0], cipher: cipher}
+	return src.Documents(f)
 }
 
 func (ee boltEngine) IDPropertyName() string {
@@ -152,13 +576,15 @@ func (ee boltEngine) IDPropertyName() string {
 }
 
 func (ee boltEngine) getID(doc Document) ([]byte, error) {
-	if id, ok := doc[ee.idPropertyName].(string); ok {
+	if id, ok := documentID(ee.idPropertyName, doc); ok {
 		return []byte(id), nil
 	}
 	return nil, errors.New("no id found in document")
 }
 
-func (ee boltEngine) Close() {}
+func (ee boltEngine) Close() {
+	ee.db.Close()
+}
 
 func (ee boltEngine) Initialise() error {
 	return nil
@@ -174,7 +600,7 @@ func (ee boltEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error)
 		return nil, "", err
 	}
 
-	id, ok := doc[ee.idPropertyName].(string)
+	id, ok := documentID(ee.idPropertyName, doc)
 	if !ok {
 		return nil, "", errors.New("no id found in document")
 	}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
 	"github.com/stretchr/testify/assert"
@@ -32,7 +41,7 @@ func testWithBolt(t *testing.T, f func(t *testing.T, e Engine)) {
 	}
 	defer os.RemoveAll(testDir)
 
-	be, err := NewBoltEngine(testDir, "coll1", "id", true)
+	be, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -149,3 +158,1057 @@ func testCount(t *testing.T, e Engine) {
 	assert.Equal(len(resources), count)
 
 }
+
+func TestBoltDeleteByQuery(t *testing.T) {
+	testWithBolt(t, testDeleteByQuery)
+}
+
+func testDeleteByQuery(t *testing.T, e Engine) {
+	assert := assert.New(t)
+
+	docs := []Document{
+		{"id": "1", "type": "person", "aliases": []interface{}{"a", "b"}},
+		{"id": "2", "type": "person", "aliases": []interface{}{"c"}},
+		{"id": "3", "type": "organisation"},
+	}
+	for _, d := range docs {
+		assert.NoError(e.Write(d))
+	}
+
+	ids, err := findIDs(e, map[string]interface{}{"type": "person", "aliases": "b"})
+	assert.NoError(err)
+	assert.Equal([]string{"1"}, ids)
+
+	// wrapping the engine hides its DocumentIterator, so ids are read in
+	// parallel
+	ids, err = findIDs(struct{ Engine }{e}, map[string]interface{}{"type": "person"})
+	assert.NoError(err)
+	assert.Equal([]string{"1", "2"}, ids)
+
+	report := deleteAll(e, []string{"1", "3", "4"})
+	assert.Equal(2, report.Deleted)
+	assert.Equal(1, report.NotFound)
+	assert.Equal(0, report.Failed)
+	assert.Equal(deleteOutcome{ID: "4", Status: deleteStatusNotFound}, report.Results[2])
+
+	count, err := e.Count()
+	assert.NoError(err)
+	assert.Equal(1, count)
+}
+
+func TestBoltDocuments(t *testing.T) {
+	testWithBolt(t, testDocuments)
+}
+
+func testDocuments(t *testing.T, e Engine) {
+	assert := assert.New(t)
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(e.Write(Document{"id": fmt.Sprintf("%d", i), "n": float64(i)}))
+	}
+
+	// wrapping the engine hides any native DocumentIterator implementation
+	for _, parallelism := range []int{0, 4} {
+		for _, coll := range []Engine{e, struct{ Engine }{e}} {
+			seen := make(map[string]bool)
+			err := forEachDocument(coll, parallelism, func(doc Document) (bool, error) {
+				seen[doc["id"].(string)] = true
+				return true, nil
+			})
+			assert.NoError(err)
+			assert.Equal(20, len(seen))
+
+			calls := 0
+			err = forEachDocument(coll, parallelism, func(doc Document) (bool, error) {
+				calls++
+				return calls < 5, nil
+			})
+			assert.NoError(err)
+			assert.Equal(5, calls)
+		}
+	}
+}
+
+func TestBoltRecode(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	e, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	doc := Document{"id": "1", "n": float64(2), "tags": []interface{}{"a", map[string]interface{}{"b": "c"}}}
+	assert.NoError(e.Write(doc))
+
+	for _, codec := range []string{"json", "msgpack", "gob"} {
+		assert.NoError(e.(Recoder).Recode(codec))
+		read, found, err := e.Read("1")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(doc, read)
+	}
+	assert.NoError(e.(Recoder).Recode("json"))
+	e.Close()
+
+	_, err = NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, Codec: "msgpack"})
+	assert.Error(err)
+
+	e, err = NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	defer e.Close()
+	read, _, err := e.Read("1")
+	assert.NoError(err)
+	assert.Equal(doc, read)
+}
+
+func TestBoltCompression(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	docs := make(map[string]Document)
+	for i, compression := range []string{"", "snappy", "zstd"} {
+		e, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, Compression: compression})
+		assert.NoError(err)
+
+		id := fmt.Sprintf("%d", i)
+		docs[id] = Document{"id": id, "name": strings.Repeat("foo ", 100)}
+		assert.NoError(e.Write(docs[id]))
+
+		// documents written with any earlier setting are still readable
+		for id, doc := range docs {
+			read, found, err := e.Read(id)
+			assert.NoError(err)
+			assert.True(found)
+			assert.Equal(doc, read)
+		}
+		e.Close()
+	}
+}
+
+func TestBoltEncryption(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	keyFile := filepath.Join(testDir, "keys")
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("# keys\nk1 "+key1+"\n"), 0600))
+	keys, err := readKeyFile(keyFile)
+	assert.NoError(err)
+
+	doc := Document{"id": "1", "name": "foo"}
+	e, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, Keys: keys, Compression: "snappy"})
+	assert.NoError(err)
+	assert.NoError(e.Write(doc))
+	e.Close()
+
+	e, err = NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	_, _, err = e.Read("1")
+	assert.Error(err)
+	e.Close()
+
+	// rotate to a new key, keeping the old one to decrypt existing documents
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("k2 "+key2+"\nk1 "+key1+"\n"), 0600))
+	keys, err = readKeyFile(keyFile)
+	assert.NoError(err)
+	e, err = NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, Keys: keys})
+	assert.NoError(err)
+	read, _, err := e.Read("1")
+	assert.NoError(err)
+	assert.Equal(doc, read)
+	assert.NoError(e.(Recoder).Recode(boltDefaultCodec))
+	e.Close()
+
+	assert.NoError(ioutil.WriteFile(keyFile, []byte("k2 "+key2+"\n"), 0600))
+	keys, err = readKeyFile(keyFile)
+	assert.NoError(err)
+	e, err = NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, Keys: keys})
+	assert.NoError(err)
+	defer e.Close()
+	read, _, err = e.Read("1")
+	assert.NoError(err)
+	assert.Equal(doc, read)
+}
+
+// failingEngine fails writes and deletes while fail is set.
+type failingEngine struct {
+	Engine
+	fail bool
+}
+
+func (fe *failingEngine) Write(resource interface{}) error {
+	if fe.fail {
+		return errors.New("unavailable")
+	}
+	return fe.Engine.Write(resource)
+}
+
+func (fe *failingEngine) Delete(id string) (bool, error) {
+	if fe.fail {
+		return false, errors.New("unavailable")
+	}
+	return fe.Engine.Delete(id)
+}
+
+func TestBoltMirror(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	primary, err := NewBoltEngine(filepath.Join(testDir, "primary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	secondaryBolt, err := NewBoltEngine(filepath.Join(testDir, "secondary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	secondary := &failingEngine{Engine: secondaryBolt}
+
+	me := NewMirrorEngine("coll1", primary, secondary, time.Hour).(*mirrorEngine)
+	defer me.Close()
+
+	assert.NoError(me.Write(Document{"id": "1", "name": "foo"}))
+	assert.NoError(me.Write(Document{"id": "2", "name": "bar"}))
+
+	secondary.fail = true
+	assert.NoError(me.Write(Document{"id": "1", "name": "baz"}))
+	_, err = me.Delete("2")
+	assert.NoError(err)
+	pending, _ := me.Pending()
+	assert.Equal([]string{"1", "2"}, pending)
+
+	report, err := diffCollections(primary, secondaryBolt)
+	assert.NoError(err)
+	assert.False(report.consistent())
+
+	// retrying while the secondary is still failing keeps the ids queued
+	me.retry()
+	pending, _ = me.Pending()
+	assert.Equal([]string{"1", "2"}, pending)
+
+	secondary.fail = false
+	me.retry()
+	pending, _ = me.Pending()
+	assert.Empty(pending)
+
+	report, err = diffCollections(primary, secondaryBolt)
+	assert.NoError(err)
+	assert.True(report.consistent())
+}
+
+// hookedEngine passes writes to a hook.
+type hookedEngine struct {
+	Engine
+	write func(resource interface{}) error
+}
+
+func (he *hookedEngine) Write(resource interface{}) error {
+	return he.write(resource)
+}
+
+func TestMirrorHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	primary, err := NewBoltEngine(filepath.Join(testDir, "primary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	secondaryBolt, err := NewBoltEngine(filepath.Join(testDir, "secondary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	secondary := &failingEngine{Engine: secondaryBolt, fail: true}
+	plain, err := NewBoltEngine(testDir, "plain", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+
+	// the mirror is wrapped with a cache and soft deletes
+	c := collectionSettings("coll1", "id")
+	c.CacheSize = 10
+	c.SoftDelete = true
+	engines := map[string]Engine{"coll1": NewMirrorEngine("coll1", primary, secondary, time.Hour), "plain": plain}
+	ah, err := newAPIHandlers(engines, map[string]CollectionSettings{"coll1": c, "plain": collectionSettings("plain", "id")})
+	assert.NoError(err)
+	defer func() {
+		for _, e := range ah.engines {
+			e.Close()
+		}
+	}()
+	api := &testAPI{ah, ah.router()}
+
+	assert.Equal(http.StatusOK, api.do("PUT", "/coll1/1", `{"id":"1"}`).Code)
+	w := api.do("GET", "/__admin/mirror/coll1", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.JSONEq(`{"pending":["1"],"pendingDrop":false}`, w.Body.String())
+
+	assert.Equal(http.StatusNotFound, api.do("GET", "/__admin/mirror/plain", "").Code)
+}
+
+func TestBoltMirrorRetryRace(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	primary, err := NewBoltEngine(filepath.Join(testDir, "primary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	secondaryBolt, err := NewBoltEngine(filepath.Join(testDir, "secondary"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	unavailable := func(interface{}) error {
+		return errors.New("unavailable")
+	}
+	secondary := &hookedEngine{Engine: secondaryBolt, write: unavailable}
+
+	me := NewMirrorEngine("coll1", primary, secondary, time.Hour).(*mirrorEngine)
+	defer me.Close()
+	assert.NoError(me.Write(Document{"id": "1", "v": 1.0}))
+
+	// the retry's write to the secondary waits while another write of the
+	// same id tries to fail on the secondary
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	calls := 0
+	secondary.write = func(resource interface{}) error {
+		if calls++; calls == 1 {
+			close(syncing)
+			<-release
+			return secondaryBolt.Write(resource)
+		}
+		return unavailable(resource)
+	}
+	retried := make(chan struct{})
+	go func() {
+		me.retry()
+		close(retried)
+	}()
+	<-syncing
+	written := make(chan error)
+	go func() {
+		written <- me.Write(Document{"id": "1", "v": 2.0})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-retried
+	assert.NoError(<-written)
+
+	// the later failure is still queued, so the secondary catches up
+	pending, _ := me.Pending()
+	assert.Equal([]string{"1"}, pending)
+	secondary.write = secondaryBolt.Write
+	me.retry()
+	pending, _ = me.Pending()
+	assert.Empty(pending)
+	doc, _, err := secondaryBolt.Read("1")
+	assert.NoError(err)
+	assert.Equal(2.0, doc.(Document)["v"])
+}
+
+func TestBoltReadThrough(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	older, err := NewBoltEngine(filepath.Join(testDir, "old"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	newer, err := NewBoltEngine(filepath.Join(testDir, "new"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	re := NewReadThroughEngine("coll1", newer, older)
+	defer re.Close()
+
+	assert.NoError(older.Write(Document{"id": "1", "name": "old"}))
+	assert.NoError(older.Write(Document{"id": "2", "name": "old"}))
+	assert.NoError(re.Write(Document{"id": "2", "name": "new"}))
+	assert.NoError(re.Write(Document{"id": "3", "name": "new"}))
+
+	count, err := re.Count()
+	assert.NoError(err)
+	assert.Equal(3, count)
+
+	names := make(map[string]interface{})
+	assert.NoError(forEachDocument(re, 0, func(doc Document) (bool, error) {
+		names[doc["id"].(string)] = doc["name"]
+		return true, nil
+	}))
+	assert.Equal(map[string]interface{}{"1": "old", "2": "new", "3": "new"}, names)
+
+	// reading a document only in the old backend copies it across
+	doc, found, err := re.Read("1")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(Document{"id": "1", "name": "old"}, doc)
+	_, found, err = newer.Read("1")
+	assert.NoError(err)
+	assert.True(found)
+
+	deleted, err := re.Delete("1")
+	assert.NoError(err)
+	assert.True(deleted)
+	_, found, err = re.Read("1")
+	assert.NoError(err)
+	assert.False(found)
+}
+
+// pausingEngine calls a hook after each read.
+type pausingEngine struct {
+	Engine
+	afterRead func()
+}
+
+func (pe *pausingEngine) Read(id string) (interface{}, bool, error) {
+	doc, found, err := pe.Engine.Read(id)
+	pe.afterRead()
+	return doc, found, err
+}
+
+func TestBoltReadThroughRace(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	olderBolt, err := NewBoltEngine(filepath.Join(testDir, "old"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	newer, err := NewBoltEngine(filepath.Join(testDir, "new"), "coll1", "id", BoltOptions{Unsafe: true})
+	assert.NoError(err)
+	assert.NoError(olderBolt.Write(Document{"id": "1", "v": 1.0}))
+
+	// a write of the same id arrives while the old document is being read
+	reading := make(chan struct{})
+	release := make(chan struct{})
+	older := &pausingEngine{Engine: olderBolt, afterRead: func() {
+		close(reading)
+		<-release
+	}}
+	re := NewReadThroughEngine("coll1", newer, older)
+	defer re.Close()
+
+	read := make(chan struct{})
+	go func() {
+		_, _, err := re.Read("1")
+		assert.NoError(err)
+		close(read)
+	}()
+	<-reading
+	written := make(chan error)
+	go func() {
+		written <- re.Write(Document{"id": "1", "v": 2.0})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-read
+	assert.NoError(<-written)
+
+	// the copy doesn't overwrite the write
+	doc, _, err := newer.Read("1")
+	assert.NoError(err)
+	assert.Equal(2.0, doc.(Document)["v"])
+}
+
+func TestBoltCache(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		ce := NewCacheEngine("cached", e, 2, time.Hour)
+		for _, id := range []string{"1", "2", "3"} {
+			assert.NoError(ce.Write(Document{"id": id, "name": "foo"}))
+		}
+
+		// reads only hit the cache once a document has been read
+		hits := func() int64 {
+			if v, ok := cacheMetrics.Get("cached.hits").(interface{ Value() int64 }); ok {
+				return v.Value()
+			}
+			return 0
+		}
+		start := hits()
+		for _, id := range []string{"1", "1", "2", "3", "1"} {
+			_, found, err := ce.Read(id)
+			assert.NoError(err)
+			assert.True(found)
+		}
+		// 1 was evicted when 3 was read
+		assert.Equal(start+1, hits())
+
+		// changing a read document doesn't change the cached one
+		doc, _, _ := ce.Read("3")
+		doc.(Document)["name"] = "changed"
+		doc, _, _ = ce.Read("3")
+		assert.Equal("foo", doc.(Document)["name"])
+
+		assert.NoError(ce.Write(Document{"id": "3", "name": "bar"}))
+		doc, _, _ = ce.Read("3")
+		assert.Equal("bar", doc.(Document)["name"])
+
+		_, err := ce.Delete("3")
+		assert.NoError(err)
+		_, found, err := ce.Read("3")
+		assert.NoError(err)
+		assert.False(found)
+	})
+}
+
+func TestBoltExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	be, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, ExpiryProperty: "expiresAt"})
+	assert.NoError(err)
+	e := NewExpiryEngine("coll1", be, "expiresAt", time.Hour, time.Hour).(*expiryEngine)
+	defer e.Close()
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	assert.NoError(e.Write(Document{"id": "1", "expiresAt": past}))
+	assert.NoError(e.Write(Document{"id": "2"}))
+	assert.NoError(e.Write(Document{"id": "3", "expiresAt": past}))
+	// rewriting a document replaces its expiry
+	assert.NoError(e.Write(Document{"id": "3", "expiresAt": time.Now().Add(time.Minute).UTC().Format(time.RFC3339)}))
+
+	_, found, err := e.Read("1")
+	assert.NoError(err)
+	assert.False(found)
+	doc, found, err := e.Read("2")
+	assert.NoError(err)
+	assert.True(found)
+	assert.Contains(doc, "expiresAt")
+
+	_, _, err = e.DecodeJSON(json.NewDecoder(strings.NewReader(`{"id": "4", "expiresAt": "tomorrow"}`)))
+	assert.Error(err)
+
+	e.reap()
+	count, err := be.Count()
+	assert.NoError(err)
+	assert.Equal(2, count)
+	_, found, err = be.Read("1")
+	assert.NoError(err)
+	assert.False(found)
+}
+
+// scanCountingEngine counts how often its documents are listed.
+type scanCountingEngine struct {
+	Engine
+	scans int
+}
+
+func (se *scanCountingEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	se.scans++
+	return se.Engine.IDs(f)
+}
+
+func (se *scanCountingEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	return se.Engine.(Expirer).DeleteExpired(property, now)
+}
+
+func TestBoltExpiryThroughWrappers(t *testing.T) {
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	be, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, ExpiryProperty: "expiresAt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &scanCountingEngine{Engine: be}
+	ie, err := NewIDRulesEngine(counting, IDRules{Lowercase: true})
+	assert.NoError(t, err)
+	de, err := NewDerivedIDEngine(ie, DerivedID{Source: "identifier"})
+	assert.NoError(t, err)
+	e := NewExpiryEngine("coll1", NewCacheEngine("coll1", de, 10, 0), "expiresAt", 0, time.Hour).(*expiryEngine)
+	defer e.Close()
+
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	assert.NoError(t, e.Write(Document{"id": "1", "expiresAt": past}))
+	assert.NoError(t, e.Write(Document{"id": "2"}))
+
+	// the cache, derived ids and id rules all pass the reaping down to the
+	// boltdb engine's expiry index
+	e.reap()
+	assert.Equal(t, 0, counting.scans)
+	count, err := be.Count()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestBoltSoftDelete(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		se := NewSoftDeleteEngine(e).(*softDeleteEngine)
+		doc := Document{"id": "1", "tags": []interface{}{"a"}}
+		assert.NoError(se.Write(doc))
+		assert.NoError(se.Write(Document{"id": "2"}))
+
+		deleted, err := se.SoftDelete("1", "duplicate")
+		assert.NoError(err)
+		assert.True(deleted)
+		deleted, err = se.SoftDelete("1", "")
+		assert.NoError(err)
+		assert.False(deleted)
+
+		_, found, err := se.Read("1")
+		assert.NoError(err)
+		assert.False(found)
+		ts, err := se.readTombstone("1")
+		assert.NoError(err)
+		assert.Equal("duplicate", ts.Reason)
+		assert.Equal(doc, ts.Document)
+
+		count, err := se.Count()
+		assert.NoError(err)
+		assert.Equal(1, count)
+		count, err = e.Count()
+		assert.NoError(err)
+		assert.Equal(2, count)
+
+		assert.Equal(errNotDeleted, se.Undelete("2"))
+		assert.Equal(ErrNotFound, se.Undelete("3"))
+		assert.NoError(se.Undelete("1"))
+		read, found, err := se.Read("1")
+		assert.NoError(err)
+		assert.True(found)
+		assert.Equal(doc, read)
+	})
+}
+
+func TestBoltIDRules(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		ie, err := NewIDRulesEngine(e, IDRules{Format: "uuid", Versions: []int{3, 4}, Lowercase: true})
+		assert.NoError(err)
+
+		doc, id, err := ie.DecodeJSON(json.NewDecoder(strings.NewReader(`{"id": " 6A2A0170-5F4E-4B1C-9E7F-3E1C7B4E2F10 "}`)))
+		assert.NoError(err)
+		assert.Equal("6a2a0170-5f4e-4b1c-9e7f-3e1c7b4e2f10", id)
+		assert.Equal(id, doc.(Document)["id"])
+		assert.NoError(ie.Write(doc))
+
+		_, found, err := ie.Read("6A2A0170-5F4E-4B1C-9E7F-3E1C7B4E2F10")
+		assert.NoError(err)
+		assert.True(found)
+
+		for _, bad := range []string{"not-a-uuid", "6a2a0170-5f4e-1b1c-9e7f-3e1c7b4e2f10", "urn:uuid:6a2a0170-5f4e-4b1c-9e7f-3e1c7b4e2f10"} {
+			_, err := normaliseID(ie, bad)
+			assert.Error(err, bad)
+		}
+
+		_, err = NewIDRulesEngine(e, IDRules{Pattern: "["})
+		assert.Error(err)
+
+		ie, err = NewIDRulesEngine(e, IDRules{Pattern: "^[a-z]+$", MaxLength: 3})
+		assert.NoError(err)
+		_, err = normaliseID(ie, "abcd")
+		assert.Error(err)
+		_, err = normaliseID(ie, "ab1")
+		assert.Error(err)
+		id, err = normaliseID(ie, "abc")
+		assert.NoError(err)
+		assert.Equal("abc", id)
+	})
+}
+
+func TestBoltDerivedID(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		de, err := NewDerivedIDEngine(e, DerivedID{Source: "identifiers[authority=http://api.ft.com/system/FT-TME].identifierValue"})
+		assert.NoError(err)
+
+		// matches java's UUID.nameUUIDFromBytes("TME-123".getBytes())
+		body := `{"identifiers": [{"authority": "http://api.ft.com/system/FACTSET", "identifierValue": "F-1"}, {"authority": "http://api.ft.com/system/FT-TME", "identifierValue": "TME-123"}]}`
+		doc, id, err := de.DecodeJSON(json.NewDecoder(strings.NewReader(body)))
+		assert.NoError(err)
+		assert.Equal("9bac1b7a-5529-3627-a5d1-cfc0268c057e", id)
+		assert.Equal(id, doc.(Document)["id"])
+
+		_, _, err = de.DecodeJSON(json.NewDecoder(strings.NewReader(`{"id": "1", "identifiers": [{"authority": "http://api.ft.com/system/FT-TME", "identifierValue": "TME-123"}]}`)))
+		assert.Error(err)
+
+		_, id, err = de.DecodeJSON(json.NewDecoder(strings.NewReader(`{"id": "1"}`)))
+		assert.NoError(err)
+		assert.Equal("1", id)
+
+		de, err = NewDerivedIDEngine(e, DerivedID{Version: 5, Namespace: "6ba7b811-9dad-11d1-80b4-00c04fd430c8", Source: "tmeId"})
+		assert.NoError(err)
+		_, id, err = de.DecodeJSON(json.NewDecoder(strings.NewReader(`{"tmeId": "TME-123"}`)))
+		assert.NoError(err)
+		assert.Equal("6aff406e-49a7-57ac-8aa1-8a50f3eb98f1", id)
+
+		for _, bad := range []DerivedID{{Version: 5, Source: "tmeId"}, {Version: 4, Source: "tmeId"}, {Source: "ids[authority.x"}, {Source: "[a=b]"}, {}} {
+			_, err := NewDerivedIDEngine(e, bad)
+			assert.Error(err, bad.Source)
+		}
+	})
+}
+
+func TestBoltIDKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	n := 0
+	for spec, body := range map[string]string{
+		"meta.uuid":                      `{"meta": {"uuid": "1"}, "name": "nested"}`,
+		"{authority}:{identifierValue}":  `{"authority": "FT-TME", "identifierValue": "TME-123"}`,
+		"{code:number}":                  `{"code": 42}`,
+		"{meta.authority}~{code:number}": `{"meta": {"authority": "FACTSET"}, "code": 7.5}`,
+	} {
+		n++
+		e, err := NewBoltEngine(testDir, fmt.Sprintf("coll%d", n), spec, BoltOptions{Unsafe: true})
+		if !assert.NoError(err, spec) {
+			continue
+		}
+		doc, id, err := e.DecodeJSON(json.NewDecoder(strings.NewReader(body)))
+		assert.NoError(err, spec)
+		assert.NoError(e.Write(doc), spec)
+
+		read, found, err := e.Read(id)
+		assert.NoError(err, spec)
+		assert.True(found, spec)
+		assert.Equal(doc, read, spec)
+
+		var ids []string
+		assert.NoError(e.IDs(func(entry rwapi.IDEntry) (bool, error) {
+			ids = append(ids, entry.ID)
+			return true, nil
+		}))
+		assert.Equal([]string{id}, ids, spec)
+
+		stored := Document{}
+		assert.NoError(setDocumentID(spec, stored, id), spec)
+		rebuilt, _ := documentID(spec, stored)
+		assert.Equal(id, rebuilt, spec)
+		e.Close()
+	}
+
+	key, err := parseIDKey("{authority}:{identifierValue}")
+	assert.NoError(err)
+	id, ok := key.of(Document{"authority": "FT-TME", "identifierValue": "TME-123"})
+	assert.True(ok)
+	assert.Equal("FT-TME:TME-123", id)
+	_, ok = key.of(Document{"authority": "FT:TME", "identifierValue": "TME-123"})
+	assert.False(ok)
+	_, err = key.values("FT-TME")
+	assert.Error(err)
+
+	for _, bad := range []string{"", "{a}{b}", "{a", "{}", "{a}/{b}"} {
+		_, err := parseIDKey(bad)
+		assert.Error(err, bad)
+	}
+}
+
+func TestJSONPointers(t *testing.T) {
+	assert := assert.New(t)
+
+	tokens, err := parsePointer("/a~1b/m~0n/0")
+	assert.NoError(err)
+	assert.Equal([]string{"a/b", "m~n", "0"}, tokens)
+	for _, bad := range []string{"a", "/a~2", "/a~"} {
+		_, err := parsePointer(bad)
+		assert.Error(err, bad)
+	}
+
+	doc := Document{"id": "1", "aliases": []interface{}{"a", "b"}, "meta": map[string]interface{}{"x": float64(1)}}
+	v, err := pointerGet(doc, []string{"aliases", "1"})
+	assert.NoError(err)
+	assert.Equal("b", v)
+	for _, missing := range [][]string{{"aliases", "2"}, {"meta", "y"}, {"id", "x"}} {
+		_, err := pointerGet(doc, missing)
+		assert.Equal(errNoValue, err, missing)
+	}
+	_, err = pointerGet(doc, []string{"aliases", "01"})
+	assert.Error(err)
+
+	_, err = pointerSet(doc, []string{"aliases", "-"}, "c")
+	assert.NoError(err)
+	_, err = pointerSet(doc, []string{"aliases", "0"}, "z")
+	assert.NoError(err)
+	_, err = pointerSet(doc, []string{"meta", "y"}, "new")
+	assert.NoError(err)
+	_, err = pointerSet(doc, []string{"missing", "y"}, "new")
+	assert.Equal(errNoValue, err)
+	_, err = pointerRemove(doc, []string{"aliases", "1"})
+	assert.NoError(err)
+	_, err = pointerRemove(doc, []string{"meta", "x"})
+	assert.NoError(err)
+	assert.Equal(Document{"id": "1", "aliases": []interface{}{"z", "c"}, "meta": map[string]interface{}{"y": "new"}}, doc)
+}
+
+func TestBoltUpdate(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		ops := &Operations{
+			Inc:         map[string]interface{}{"count": float64(1)},
+			AddToSet:    map[string]interface{}{"aliases": "a"},
+			SetOnInsert: map[string]interface{}{"meta.created": "now"},
+		}
+		assert.NoError(ops.check(e.IDPropertyName()))
+
+		doc, created, err := e.(Updater).Update("1", ops)
+		assert.NoError(err)
+		assert.True(created)
+		assert.Equal(Document{"id": "1", "count": float64(1), "aliases": []interface{}{"a"}, "meta": map[string]interface{}{"created": "now"}}, doc)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, _, err := e.(Updater).Update("1", &Operations{
+					Inc:  map[string]interface{}{"count": float64(1)},
+					Push: map[string]interface{}{"ids": float64(i)},
+				})
+				assert.NoError(err)
+			}(i)
+		}
+		wg.Wait()
+
+		doc, created, err = e.(Updater).Update("1", &Operations{
+			Pull:        map[string]interface{}{"aliases": "a"},
+			SetOnInsert: map[string]interface{}{"meta.created": "later"},
+		})
+		assert.NoError(err)
+		assert.False(created)
+		assert.Equal(float64(21), doc["count"])
+		assert.Len(doc["ids"], 20)
+		assert.Equal([]interface{}{}, doc["aliases"])
+		assert.Equal("now", doc["meta"].(map[string]interface{})["created"])
+
+		_, _, err = e.(Updater).Update("1", &Operations{Push: map[string]interface{}{"count": "x"}})
+		assert.IsType(&opsError{}, err)
+
+		for _, bad := range []*Operations{
+			{},
+			{Inc: map[string]interface{}{"count": "x"}},
+			{Inc: map[string]interface{}{"id": float64(1)}},
+			{Push: map[string]interface{}{"a.b": 1}, Pull: map[string]interface{}{"a": 1}},
+			{Push: map[string]interface{}{"a..b": 1}},
+		} {
+			assert.Error(bad.check(e.IDPropertyName()))
+		}
+
+		// engines that aren't Updaters are updated under a lock instead
+		schemas, err := newSchemaRegistry(nil)
+		assert.NoError(err)
+		ah := &apiHandlers{schemas: schemas, locks: newKeyedMutex()}
+		wrapped := &failingEngine{Engine: e}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, _, err := ah.updateDocument("coll1", wrapped, "2", &Operations{Inc: map[string]interface{}{"count": float64(1)}})
+				assert.NoError(err)
+			}()
+		}
+		wg.Wait()
+		read, _, err := wrapped.Read("2")
+		assert.NoError(err)
+		assert.Equal(float64(10), read.(Document)["count"])
+	})
+}
+
+// updateCountingEngine counts the documents it updates and writes.
+type updateCountingEngine struct {
+	Engine
+	updates, writes int
+}
+
+func (ue *updateCountingEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	ue.updates++
+	return ue.Engine.(Updater).Update(id, ops)
+}
+
+func (ue *updateCountingEngine) Write(resource interface{}) error {
+	ue.writes++
+	return ue.Engine.Write(resource)
+}
+
+func TestBoltUpdateThroughWrappers(t *testing.T) {
+	assert := assert.New(t)
+
+	testDir, err := ioutil.TempDir(os.TempDir(), "restorage-bolt-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(testDir)
+
+	be, err := NewBoltEngine(testDir, "coll1", "id", BoltOptions{Unsafe: true, ExpiryProperty: "expiresAt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &updateCountingEngine{Engine: be}
+	ie, err := NewIDRulesEngine(counting, IDRules{Lowercase: true})
+	assert.NoError(err)
+	de, err := NewDerivedIDEngine(ie, DerivedID{Source: "identifier"})
+	assert.NoError(err)
+	ee := NewExpiryEngine("coll1", NewCacheEngine("coll1", de, 10, 0), "expiresAt", time.Hour, time.Hour)
+	e, err := NewRedirectEngine(NewSoftDeleteEngine(ee), "redirect")
+	assert.NoError(err)
+	defer e.Close()
+
+	schemas, err := newSchemaRegistry(nil)
+	assert.NoError(err)
+	ah := &apiHandlers{schemas: schemas, locks: newKeyedMutex()}
+	inc := &Operations{Inc: map[string]interface{}{"n": float64(1)}}
+	read := func(id string) Document {
+		doc, found, err := e.Read(id)
+		assert.NoError(err)
+		if !found {
+			return nil
+		}
+		return doc.(Document)
+	}
+
+	// every wrapper passes the operations down to the boltdb engine, and the
+	// cache doesn't keep the old document
+	assert.NoError(e.Write(Document{"id": "a", "n": float64(1)}))
+	assert.Equal(float64(1), read("a")["n"])
+	doc, created, err := ah.updateDocument("coll1", e, "a", inc)
+	assert.NoError(err)
+	assert.False(created)
+	assert.Equal(float64(2), doc["n"])
+	assert.Equal(float64(2), read("a")["n"])
+	assert.Equal(1, counting.updates)
+	assert.Equal(1, counting.writes)
+
+	// created documents are given an expiry time
+	doc, created, err = ah.updateDocument("coll1", e, "b", inc)
+	assert.NoError(err)
+	assert.True(created)
+	_, expires := expiryTime(doc, "expiresAt")
+	assert.True(expires)
+	assert.Equal(2, counting.updates)
+
+	// soft deleted and expired documents, and changes to derived ids' source
+	// identifiers, are read, changed and written instead
+	_, err = e.Delete("a")
+	assert.NoError(err)
+	past := time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)
+	assert.NoError(be.Write(Document{"id": "c", "n": float64(5), "expiresAt": past}))
+	for _, id := range []string{"a", "c"} {
+		doc, created, err = ah.updateDocument("coll1", e, id, inc)
+		assert.NoError(err)
+		assert.True(created, id)
+		assert.Equal(float64(1), doc["n"], id)
+	}
+	_, _, err = ah.updateDocument("coll1", e, "b", &Operations{SetOnInsert: map[string]interface{}{"identifier": "x"}})
+	assert.NoError(err)
+	assert.Equal(2, counting.updates)
+	assert.Nil(read("a")[tombstoneProperty])
+}
+
+func TestBoltApplyBatch(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		assert.NoError(e.Write(Document{"id": "1", "name": "old"}))
+		found, err := e.(Batcher).ApplyBatch([]BatchOperation{
+			{ID: "2", Document: Document{"id": "2", "name": "merged"}},
+			{Delete: true, ID: "1"},
+			{Delete: true, ID: "3"},
+		})
+		assert.NoError(err)
+		assert.Equal([]bool{false, true, false}, found)
+
+		_, found1, err := e.Read("1")
+		assert.NoError(err)
+		assert.False(found1)
+		doc, found2, err := e.Read("2")
+		assert.NoError(err)
+		assert.True(found2)
+		assert.Equal(Document{"id": "2", "name": "merged"}, doc)
+	})
+}
+
+func TestBoltRedirects(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		re, err := NewRedirectEngine(e, "redirect")
+		assert.NoError(err)
+		r := re.(*redirectEngine)
+		_, err = NewRedirectEngine(e, "bounce")
+		assert.Error(err)
+
+		for _, id := range []string{"1", "2", "3"} {
+			assert.NoError(re.Write(Document{"id": id}))
+		}
+		assert.Equal(ErrNotFound, r.Redirect("4", "5", false))
+		assert.IsType(&redirectError{}, r.Redirect("1", "2", false))
+		assert.IsType(&redirectError{}, r.Redirect("1", "1", true))
+
+		assert.NoError(r.Redirect("2", "1", true))
+		assert.NoError(r.Redirect("3", "2", true))
+		assert.NoError(r.Redirect("old", "3", false))
+		// redirects are stored to the canonical document
+		rd, err := r.readRedirect("3")
+		assert.NoError(err)
+		assert.Equal("1", rd.To)
+		assert.IsType(&redirectError{}, r.Redirect("1", "old", true))
+
+		target, err := r.resolve("old")
+		assert.NoError(err)
+		assert.Equal("1", target)
+		target, err = r.resolve("1")
+		assert.NoError(err)
+		assert.Equal("", target)
+
+		_, found, err := re.Read("2")
+		assert.NoError(err)
+		assert.False(found)
+		count, err := re.Count()
+		assert.NoError(err)
+		assert.Equal(1, count)
+		deleted, err := re.Delete("2")
+		assert.NoError(err)
+		assert.False(deleted)
+
+		aliases, err := r.Aliases("1")
+		assert.NoError(err)
+		assert.Equal([]string{"2", "3", "old"}, aliases)
+
+		removed, err := r.RemoveRedirect("old")
+		assert.NoError(err)
+		assert.True(removed)
+		removed, err = r.RemoveRedirect("1")
+		assert.NoError(err)
+		assert.False(removed)
+	})
+}
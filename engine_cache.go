@@ -0,0 +1,257 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+)
+
+// cacheMetrics counts hits, misses and evictions for each cached collection,
+// published at /debug/vars.
+var cacheMetrics = expvar.NewMap("cache")
+
+// cacheEngine keeps recently read documents in memory, up to size documents
+// and for at most ttl, or indefinitely if ttl is zero. Writes, deletes and
+// drops invalidate the documents they touch.
+type cacheEngine struct {
+	engine Engine
+	name   string
+	size   int
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation changes on every invalidation, so that a read which raced
+	// with a write doesn't cache what it read.
+	generation uint64
+}
+
+type cacheEntry struct {
+	id      string
+	doc     Document
+	expires time.Time
+}
+
+// NewCacheEngine returns an Engine that caches reads from e.
+func NewCacheEngine(name string, e Engine, size int, ttl time.Duration) Engine {
+	return &cacheEngine{
+		engine:  e,
+		name:    name,
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// cachedEngines wraps each engine whose collection has a cache size
+// configured.
+func cachedEngines(engines map[string]Engine, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	cached := make(map[string]Engine)
+	for name, e := range engines {
+		c := collections[name]
+		if c.CacheSize <= 0 {
+			cached[name] = e
+			continue
+		}
+		var ttl time.Duration
+		if c.CacheTTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(c.CacheTTL); err != nil {
+				return nil, fmt.Errorf("invalid cache ttl for %s: %v", name, err)
+			}
+		}
+		cached[name] = NewCacheEngine(name, e, c.CacheSize, ttl)
+	}
+	return cached, nil
+}
+
+func (ce *cacheEngine) Read(id string) (interface{}, bool, error) {
+	ce.mu.Lock()
+	if el, ok := ce.entries[id]; ok {
+		entry := el.Value.(*cacheEntry)
+		if entry.expires.IsZero() || time.Now().Before(entry.expires) {
+			ce.lru.MoveToFront(el)
+			ce.mu.Unlock()
+			cacheMetrics.Add(ce.name+".hits", 1)
+			return cloneDocument(entry.doc), true, nil
+		}
+		ce.remove(el)
+	}
+	generation := ce.generation
+	ce.mu.Unlock()
+	cacheMetrics.Add(ce.name+".misses", 1)
+
+	doc, found, err := ce.engine.Read(id)
+	if err != nil || !found {
+		return doc, found, err
+	}
+
+	ce.mu.Lock()
+	if ce.generation == generation {
+		ce.add(id, cloneDocument(doc.(Document)))
+	}
+	ce.mu.Unlock()
+	return doc, true, nil
+}
+
+// add caches a document, evicting the least recently used one if the cache
+// is full. ce.mu must be held.
+func (ce *cacheEngine) add(id string, doc Document) {
+	entry := &cacheEntry{id: id, doc: doc}
+	if ce.ttl > 0 {
+		entry.expires = time.Now().Add(ce.ttl)
+	}
+	if el, ok := ce.entries[id]; ok {
+		el.Value = entry
+		ce.lru.MoveToFront(el)
+		return
+	}
+	ce.entries[id] = ce.lru.PushFront(entry)
+	if ce.lru.Len() > ce.size {
+		ce.remove(ce.lru.Back())
+		cacheMetrics.Add(ce.name+".evictions", 1)
+	}
+}
+
+// remove drops a cached document. ce.mu must be held.
+func (ce *cacheEngine) remove(el *list.Element) {
+	ce.lru.Remove(el)
+	delete(ce.entries, el.Value.(*cacheEntry).id)
+}
+
+func (ce *cacheEngine) invalidate(id string) {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.generation++
+	if el, ok := ce.entries[id]; ok {
+		ce.remove(el)
+	}
+}
+
+func (ce *cacheEngine) invalidateAll() {
+	ce.mu.Lock()
+	defer ce.mu.Unlock()
+	ce.generation++
+	ce.entries = make(map[string]*list.Element)
+	ce.lru.Init()
+}
+
+// Write invalidates before and after writing, so that neither an earlier
+// cached copy nor one read while the write was in progress survives it.
+func (ce *cacheEngine) Write(resource interface{}) error {
+	doc, _ := resource.(Document)
+	id, _ := documentID(ce.engine.IDPropertyName(), doc)
+	ce.invalidate(id)
+	defer ce.invalidate(id)
+	return ce.engine.Write(resource)
+}
+
+func (ce *cacheEngine) Delete(id string) (bool, error) {
+	ce.invalidate(id)
+	defer ce.invalidate(id)
+	return ce.engine.Delete(id)
+}
+
+func (ce *cacheEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	ce.invalidate(id)
+	defer ce.invalidate(id)
+	return update(ce.engine, id, ops)
+}
+
+func (ce *cacheEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	for _, op := range ops {
+		ce.invalidate(op.ID)
+	}
+	defer func() {
+		for _, op := range ops {
+			ce.invalidate(op.ID)
+		}
+	}()
+	return applyBatch(ce.engine, ops)
+}
+
+func (ce *cacheEngine) Drop() (bool, error) {
+	ce.invalidateAll()
+	defer ce.invalidateAll()
+	return ce.engine.Drop()
+}
+
+// DeleteExpired lets expired documents be deleted natively by the cached
+// engine.
+func (ce *cacheEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	n, err := deleteExpired(ce.engine, property, now)
+	if n > 0 {
+		ce.invalidateAll()
+	}
+	return n, err
+}
+
+func (ce *cacheEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(ce.engine, 0, f)
+}
+
+func (ce *cacheEngine) Count() (int, error) {
+	return ce.engine.Count()
+}
+
+func (ce *cacheEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return ce.engine.IDs(f)
+}
+
+func (ce *cacheEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	return ce.engine.DecodeJSON(dec)
+}
+
+func (ce *cacheEngine) Unwrap() Engine {
+	return ce.engine
+}
+
+func (ce *cacheEngine) IDPropertyName() string {
+	return ce.engine.IDPropertyName()
+}
+
+func (ce *cacheEngine) Initialise() error {
+	return ce.engine.Initialise()
+}
+
+func (ce *cacheEngine) Check() error {
+	return ce.engine.Check()
+}
+
+func (ce *cacheEngine) Close() {
+	ce.engine.Close()
+}
+
+// cloneDocument deep copies a document, so that callers can't change cached
+// documents.
+func cloneDocument(doc Document) Document {
+	return Document(cloneValue(map[string]interface{}(doc)).(map[string]interface{}))
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		c := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			c[k] = cloneValue(e)
+		}
+		return c
+	case Document:
+		return cloneDocument(v)
+	case []interface{}:
+		c := make([]interface{}, len(v))
+		for i, e := range v {
+			c[i] = cloneValue(e)
+		}
+		return c
+	default:
+		return v
+	}
+}
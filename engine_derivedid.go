@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/pborman/uuid"
+)
+
+// DerivedID configures a collection whose ids are name based uuids derived
+// from a value in each document, such as a source authority's identifier.
+type DerivedID struct {
+	// Version is 3 (md5, the default) or 5 (sha1).
+	Version int `json:"version"`
+	// Namespace is the uuid names are hashed with. Version 3 ids may leave it
+	// out to match java's UUID.nameUUIDFromBytes, which hashes the name alone.
+	Namespace string `json:"namespace"`
+	// Source is the path of the name in the document, e.g.
+	// "identifiers[authority=http://api.ft.com/system/FT-TME].identifierValue".
+	// Segments are separated by dots, and a segment of the form
+	// "name[key=value]" selects the first element of the array "name" whose
+	// key is value.
+	Source string `json:"source"`
+	// Prefix, if set, is prepended to the name before hashing.
+	Prefix string `json:"prefix"`
+
+	namespace uuid.UUID
+	source    []pathSegment
+}
+
+type pathSegment struct {
+	name       string
+	key, value string
+	selector   bool
+}
+
+func (d *DerivedID) compile() error {
+	if d.Version == 0 {
+		d.Version = 3
+	}
+	if d.Version != 3 && d.Version != 5 {
+		return fmt.Errorf("derived ids must be version 3 or 5 uuids, not version %d", d.Version)
+	}
+	if d.Namespace != "" {
+		if d.namespace = uuid.Parse(d.Namespace); d.namespace == nil {
+			return fmt.Errorf("derived id namespace %q is not a uuid", d.Namespace)
+		}
+	} else if d.Version == 5 {
+		return errors.New("version 5 derived ids need a namespace")
+	}
+	var err error
+	if d.source, err = parseSelectorPath(d.Source); err != nil {
+		return fmt.Errorf("invalid derived id source: %v", err)
+	}
+	return nil
+}
+
+// parseSelectorPath splits a path into its segments. Dots within selectors
+// don't separate segments, so selector values may be urls.
+func parseSelectorPath(path string) ([]pathSegment, error) {
+	if path == "" {
+		return nil, errors.New("empty path")
+	}
+	var segments []pathSegment
+	depth, start := 0, 0
+	for i := 0; i <= len(path); i++ {
+		if i < len(path) {
+			switch path[i] {
+			case '[':
+				depth++
+				continue
+			case ']':
+				depth--
+				continue
+			case '.':
+				if depth > 0 {
+					continue
+				}
+			default:
+				continue
+			}
+		}
+		if depth != 0 {
+			return nil, fmt.Errorf("unbalanced brackets in %s", path)
+		}
+		segment, err := parseSelectorSegment(path[start:i])
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+		start = i + 1
+	}
+	return segments, nil
+}
+
+func parseSelectorSegment(s string) (pathSegment, error) {
+	open := strings.IndexByte(s, '[')
+	if open < 0 {
+		if s == "" {
+			return pathSegment{}, errors.New("empty path segment")
+		}
+		return pathSegment{name: s}, nil
+	}
+	if !strings.HasSuffix(s, "]") {
+		return pathSegment{}, fmt.Errorf("selector %s must end the segment", s)
+	}
+	kv := strings.SplitN(s[open+1:len(s)-1], "=", 2)
+	if open == 0 || len(kv) != 2 || kv[0] == "" {
+		return pathSegment{}, fmt.Errorf("selector %s isn't of the form name[key=value]", s)
+	}
+	return pathSegment{name: s[:open], key: kv[0], value: kv[1], selector: true}, nil
+}
+
+// selectPath resolves parsed path segments against a document.
+func selectPath(doc Document, segments []pathSegment) (interface{}, bool) {
+	var current interface{} = map[string]interface{}(doc)
+	for _, segment := range segments {
+		m, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if current, ok = m[segment.name]; !ok {
+			return nil, false
+		}
+		if !segment.selector {
+			continue
+		}
+		arr, ok := current.([]interface{})
+		if !ok {
+			return nil, false
+		}
+		found := false
+		for _, elem := range arr {
+			if em, ok := elem.(map[string]interface{}); ok && fmt.Sprint(em[segment.key]) == segment.value {
+				current, found = em, true
+				break
+			}
+		}
+		if !found {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// derive returns the id for a document, and false if it has nothing to derive
+// one from.
+func (d *DerivedID) derive(doc Document) (string, bool) {
+	v, found := selectPath(doc, d.source)
+	name, ok := v.(string)
+	if !found || !ok || name == "" {
+		return "", false
+	}
+	data := []byte(d.Prefix + name)
+	if d.Version == 5 {
+		return uuid.NewHash(sha1.New(), d.namespace, data, 5).String(), true
+	}
+	return uuid.NewHash(md5.New(), d.namespace, data, 3).String(), true
+}
+
+// deriveID returns the id derived from a document, if its collection has
+// derived ids and the document has a source identifier.
+func deriveID(coll Engine, doc Document) (string, bool) {
+	for _, e := range engineChain(coll) {
+		if de, ok := e.(*derivedIDEngine); ok {
+			return de.derived.derive(doc)
+		}
+	}
+	return "", false
+}
+
+// derivedIDEngine sets the ids of decoded documents from their source
+// identifiers. Documents without one keep the id they were given.
+type derivedIDEngine struct {
+	engine  Engine
+	derived *DerivedID
+}
+
+// NewDerivedIDEngine returns an Engine that derives the ids of documents
+// written to e.
+func NewDerivedIDEngine(e Engine, derived DerivedID) (Engine, error) {
+	if err := derived.compile(); err != nil {
+		return nil, err
+	}
+	return &derivedIDEngine{engine: e, derived: &derived}, nil
+}
+
+// derivedIDEngines wraps each engine whose collection has derived ids
+// configured.
+func derivedIDEngines(engines map[string]Engine, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	wrapped := make(map[string]Engine)
+	for name, e := range engines {
+		if derived := collections[name].DerivedID; derived != nil {
+			var err error
+			if e, err = NewDerivedIDEngine(e, *derived); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		wrapped[name] = e
+	}
+	return wrapped, nil
+}
+
+// DecodeJSON rejects documents whose id differs from the one derived from
+// them, since they would otherwise be stored twice.
+func (de *derivedIDEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	var doc Document
+	if err := dec.Decode(&doc); err != nil {
+		return nil, "", err
+	}
+	if id, ok := de.derived.derive(doc); ok {
+		idProp := de.engine.IDPropertyName()
+		if given, found := documentID(idProp, doc); found && given != id {
+			return nil, "", fmt.Errorf("document %s is %v, but its id is derived as %s", idProp, given, id)
+		}
+		if err := setDocumentID(idProp, doc, id); err != nil {
+			return nil, "", err
+		}
+	}
+	return decodeDocument(de.engine, doc)
+}
+
+func (de *derivedIDEngine) Read(id string) (interface{}, bool, error) {
+	return de.engine.Read(id)
+}
+
+func (de *derivedIDEngine) Write(resource interface{}) error {
+	return de.engine.Write(resource)
+}
+
+// Update leaves operations that could change a document's source identifier,
+// and so its derived id, to be checked by reading, changing and writing the
+// document instead.
+func (de *derivedIDEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	if ops.touches(de.derived.source[0].name) {
+		return nil, false, errUpdateUnsupported
+	}
+	return update(de.engine, id, ops)
+}
+
+func (de *derivedIDEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	return applyBatch(de.engine, ops)
+}
+
+func (de *derivedIDEngine) Delete(id string) (bool, error) {
+	return de.engine.Delete(id)
+}
+
+func (de *derivedIDEngine) Drop() (bool, error) {
+	return de.engine.Drop()
+}
+
+func (de *derivedIDEngine) Count() (int, error) {
+	return de.engine.Count()
+}
+
+func (de *derivedIDEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return de.engine.IDs(f)
+}
+
+func (de *derivedIDEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(de.engine, 0, f)
+}
+
+// DeleteExpired lets expired documents be deleted natively by the wrapped
+// engine.
+func (de *derivedIDEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	return deleteExpired(de.engine, property, now)
+}
+
+func (de *derivedIDEngine) Unwrap() Engine {
+	return de.engine
+}
+
+func (de *derivedIDEngine) IDPropertyName() string {
+	return de.engine.IDPropertyName()
+}
+
+func (de *derivedIDEngine) Initialise() error {
+	return de.engine.Initialise()
+}
+
+func (de *derivedIDEngine) Check() error {
+	return de.engine.Check()
+}
+
+func (de *derivedIDEngine) Close() {
+	de.engine.Close()
+}
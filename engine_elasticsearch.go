@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -58,7 +59,7 @@ func (ee *elasticEngine) Drop() (bool, error) {
 
 func (ee *elasticEngine) Write(resource interface{}) error {
 	cont := resource.(Document)
-	id, ok := cont[ee.idPropertyName].(string)
+	id, ok := documentID(ee.idPropertyName, cont)
 	if !ok || id == "" {
 		return errors.New("missing or invalid id")
 	}
@@ -180,6 +181,121 @@ type esGetResult struct {
 	Source Document `json:"_source"`
 }
 
+// esOpsScript applies Operations, passed as lists of {path, value} params, to
+// a document. It runs as a scripted upsert, so the source is empty if the
+// document is being created.
+const esOpsScript = `
+Map parent(Map m, List path) {
+	for (int i = 0; i < path.size() - 1; i++) {
+		if (!(m.get(path.get(i)) instanceof Map)) {
+			m.put(path.get(i), new HashMap());
+		}
+		m = (Map) m.get(path.get(i));
+	}
+	return m;
+}
+List array(Map m, String k) {
+	if (m.get(k) == null) {
+		m.put(k, new ArrayList());
+	} else if (!(m.get(k) instanceof List)) {
+		throw new IllegalArgumentException(k + " isn't an array");
+	}
+	return (List) m.get(k);
+}
+String last(List path) {
+	return (String) path.get(path.size() - 1);
+}
+if (ctx._source.isEmpty()) {
+	for (op in params.insert) { parent(ctx._source, op.path).put(last(op.path), op.value); }
+}
+for (op in params.inc) {
+	Map m = parent(ctx._source, op.path);
+	def v = m.get(last(op.path));
+	m.put(last(op.path), v == null ? op.value : v + op.value);
+}
+for (op in params.push) { array(parent(ctx._source, op.path), last(op.path)).add(op.value); }
+for (op in params.addToSet) {
+	List a = array(parent(ctx._source, op.path), last(op.path));
+	if (!a.contains(op.value)) { a.add(op.value); }
+}
+for (op in params.pull) {
+	Map m = parent(ctx._source, op.path);
+	if (m.get(last(op.path)) != null) { array(m, last(op.path)).removeIf(x -> x == op.value); }
+}
+`
+
+type esPathValue struct {
+	Path  []string    `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func esPathValues(fields map[string]interface{}) []esPathValue {
+	pvs := []esPathValue{}
+	for path, value := range fields {
+		pvs = append(pvs, esPathValue{strings.Split(path, "."), value})
+	}
+	return pvs
+}
+
+// Update applies operations with a painless script, which elasticsearch runs
+// atomically, retrying if the document changes concurrently.
+func (ee *elasticEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	key, err := parseIDKey(ee.idPropertyName)
+	if err != nil {
+		return nil, false, err
+	}
+	values, err := key.values(id)
+	if err != nil {
+		return nil, false, &opsError{err}
+	}
+	insert := esPathValues(ops.SetOnInsert)
+	for i, field := range key.fields {
+		insert = append(insert, esPathValue{strings.Split(field.path, "."), values[i]})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"scripted_upsert": true,
+		"upsert":          map[string]interface{}{},
+		"script": map[string]interface{}{
+			"lang":   "painless",
+			"inline": esOpsScript,
+			"params": map[string]interface{}{
+				"insert":   insert,
+				"inc":      esPathValues(ops.Inc),
+				"push":     esPathValues(ops.Push),
+				"addToSet": esPathValues(ops.AddToSet),
+				"pull":     esPathValues(ops.Pull),
+			},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	u := fmt.Sprintf("%s/%s/%s/%s/_update?retry_on_conflict=5&_source=true", ee.baseURL, ee.indexName, ee.collectionName, id)
+	resp, err := ee.client.Post(u, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated:
+	case resp.StatusCode == http.StatusBadRequest:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return nil, false, &opsError{fmt.Errorf("update failed: %s", msg)}
+	default:
+		return nil, false, fmt.Errorf("update failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Result string      `json:"result"`
+		Get    esGetResult `json:"get"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, false, err
+	}
+	return result.Get.Source, result.Result == "created", nil
+}
+
 func (ee elasticEngine) IDs(callback func(rwapi.IDEntry) (bool, error)) error {
 	count, err := ee.Count()
 	if err != nil {
@@ -219,6 +335,80 @@ func (ee elasticEngine) IDs(callback func(rwapi.IDEntry) (bool, error)) error {
 	return nil
 }
 
+// Documents streams every document in the collection using the scroll api,
+// which also gives a consistent view of the index for the whole iteration.
+func (ee elasticEngine) Documents(f func(Document) (bool, error)) error {
+	q := `{"query":{"match_all": {}}, "size": 500, "sort": ["_doc"]}`
+	res, err := ee.client.Post(fmt.Sprintf("%s/%s/%s/_search?scroll=%s", ee.baseURL, ee.indexName, ee.collectionName, esScrollKeepAlive), "application/json", strings.NewReader(q))
+	if err != nil {
+		return err
+	}
+
+	for {
+		result, err := ee.decodeScrollResult(res)
+		if err != nil {
+			return err
+		}
+		if len(result.Hits.Hits) == 0 {
+			return ee.clearScroll(result.ScrollID)
+		}
+		for _, h := range result.Hits.Hits {
+			more, err := f(h.Source)
+			if !more || err != nil {
+				ee.clearScroll(result.ScrollID)
+				return err
+			}
+		}
+
+		body, err := json.Marshal(esScrollRequest{Scroll: esScrollKeepAlive, ScrollID: result.ScrollID})
+		if err != nil {
+			return err
+		}
+		res, err = ee.client.Post(fmt.Sprintf("%s/_search/scroll", ee.baseURL), "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (ee elasticEngine) decodeScrollResult(res *http.Response) (esScrollResult, error) {
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+
+	var result esScrollResult
+	switch {
+	case res.StatusCode == 200:
+	case res.StatusCode == 400:
+		return result, ErrInvalidQuery
+	case res.StatusCode == 404:
+		return result, ErrNotFound
+	default:
+		return result, fmt.Errorf("scroll failed: %s", res.Status)
+	}
+
+	err := json.NewDecoder(res.Body).Decode(&result)
+	return result, err
+}
+
+func (ee elasticEngine) clearScroll(scrollID string) error {
+	body, err := json.Marshal(esClearScrollRequest{ScrollID: []string{scrollID}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/_search/scroll", ee.baseURL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := ee.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
 func (ee elasticEngine) IDPropertyName() string {
 	return ee.idPropertyName
 }
@@ -229,7 +419,7 @@ func (ee elasticEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, erro
 		return nil, "", err
 	}
 
-	id, ok := doc[ee.idPropertyName].(string)
+	id, ok := documentID(ee.idPropertyName, doc)
 	if !ok {
 		return nil, "", errors.New("no id found in document")
 	}
@@ -274,3 +464,23 @@ type hitResult struct {
 type esSearchID struct {
 	ID string `json:"_id"`
 }
+
+const esScrollKeepAlive = "1m"
+
+type esScrollRequest struct {
+	Scroll   string `json:"scroll"`
+	ScrollID string `json:"scroll_id"`
+}
+
+type esClearScrollRequest struct {
+	ScrollID []string `json:"scroll_id"`
+}
+
+type esScrollResult struct {
+	ScrollID string             `json:"_scroll_id"`
+	Hits     esScrollHitsResult `json:"hits"`
+}
+
+type esScrollHitsResult struct {
+	Hits []esGetResult `json:"hits"`
+}
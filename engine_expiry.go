@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+)
+
+// defaultExpiryProperty holds a document's expiry time when a collection has
+// a ttl but no expiry property configured.
+const defaultExpiryProperty = "expiresAt"
+
+// expiryReapInterval is how often expired documents are deleted.
+const expiryReapInterval = time.Minute
+
+// expiryEngine hides documents whose expiry property, an RFC 3339 time, has
+// passed, and deletes them in the background. Documents written without an
+// expiry time are given one ttl from now, if a ttl is configured.
+//
+// Expired documents are hidden from reads and dumps as soon as they expire,
+// but are still listed and counted until they are deleted.
+type expiryEngine struct {
+	engine   Engine
+	name     string
+	property string
+	ttl      time.Duration
+	stop     chan struct{}
+}
+
+// NewExpiryEngine returns an Engine that expires documents from e, deleting
+// expired documents every interval.
+func NewExpiryEngine(name string, e Engine, property string, ttl time.Duration, interval time.Duration) Engine {
+	ee := &expiryEngine{
+		engine:   e,
+		name:     name,
+		property: property,
+		ttl:      ttl,
+		stop:     make(chan struct{}),
+	}
+	go ee.reapLoop(interval)
+	return ee
+}
+
+// expiringEngines wraps each engine whose collection has expiry configured.
+func expiringEngines(engines map[string]Engine, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	expiring := make(map[string]Engine)
+	for name, e := range engines {
+		c := collections[name]
+		property := c.expiryProperty()
+		if property == "" {
+			expiring[name] = e
+			continue
+		}
+		var ttl time.Duration
+		if c.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(c.TTL); err != nil {
+				return nil, fmt.Errorf("invalid ttl for %s: %v", name, err)
+			}
+		}
+		expiring[name] = NewExpiryEngine(name, e, property, ttl, expiryReapInterval)
+	}
+	return expiring, nil
+}
+
+// expiryProperty returns the property holding documents' expiry times, or
+// empty if the collection's documents don't expire.
+func (c CollectionSettings) expiryProperty() string {
+	if c.ExpiryProperty == "" && c.TTL != "" {
+		return defaultExpiryProperty
+	}
+	return c.ExpiryProperty
+}
+
+// expiryTime returns the time a document expires at, if it has one. Times
+// are RFC 3339 strings in documents, but engines may read them natively.
+func expiryTime(doc Document, property string) (time.Time, bool) {
+	switch v := doc[property].(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case time.Time:
+		return v, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func expired(doc Document, property string, now time.Time) bool {
+	t, ok := expiryTime(doc, property)
+	return ok && !t.After(now)
+}
+
+// setTTL sets a document to expire ttl from now. It fails if the collection
+// doesn't have expiry configured.
+func setTTL(coll Engine, resource interface{}, ttl string) error {
+	var ee *expiryEngine
+	for _, e := range engineChain(coll) {
+		if found, ok := e.(*expiryEngine); ok {
+			ee = found
+			break
+		}
+	}
+	if ee == nil {
+		return errors.New("collection doesn't have expiry configured")
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("invalid ttl %s", ttl)
+	}
+	resource.(Document)[ee.property] = time.Now().Add(d).UTC().Format(time.RFC3339Nano)
+	return nil
+}
+
+func (ee *expiryEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	resource, id, err := ee.engine.DecodeJSON(dec)
+	if err != nil {
+		return resource, id, err
+	}
+	doc, _ := resource.(Document)
+	if v, found := doc[ee.property]; found {
+		if _, ok := expiryTime(doc, ee.property); !ok {
+			return nil, "", fmt.Errorf("invalid %s %v, expected an RFC 3339 time", ee.property, v)
+		}
+	}
+	return resource, id, nil
+}
+
+func (ee *expiryEngine) Write(resource interface{}) error {
+	return ee.engine.Write(ee.withExpiry(resource))
+}
+
+// ApplyBatch gives the documents it puts an expiry time like Write does.
+func (ee *expiryEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	stamped := make([]BatchOperation, len(ops))
+	for i, op := range ops {
+		if !op.Delete {
+			op.Document = ee.withExpiry(op.Document)
+		}
+		stamped[i] = op
+	}
+	return applyBatch(ee.engine, stamped)
+}
+
+// withExpiry returns a copy of a document expiring ttl from now, if there's a
+// ttl and it doesn't have an expiry time already.
+func (ee *expiryEngine) withExpiry(resource interface{}) interface{} {
+	doc, _ := resource.(Document)
+	if _, found := doc[ee.property]; found || ee.ttl <= 0 {
+		return resource
+	}
+	withExpiry := make(Document, len(doc)+1)
+	for k, v := range doc {
+		withExpiry[k] = v
+	}
+	withExpiry[ee.property] = time.Now().Add(ee.ttl).UTC().Format(time.RFC3339Nano)
+	return withExpiry
+}
+
+// Update gives documents it creates an expiry time like Write does. Expired
+// documents, which reads treat as absent, documents without an expiry time
+// when there's a ttl, and operations on the expiry property are left to be
+// read, changed and written instead.
+func (ee *expiryEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	if ops.touches(ee.property) {
+		return nil, false, errUpdateUnsupported
+	}
+	doc, found, err := ee.engine.Read(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if found {
+		_, hasExpiry := doc.(Document)[ee.property]
+		if expired(doc.(Document), ee.property, time.Now()) || (!hasExpiry && ee.ttl > 0) {
+			return nil, false, errUpdateUnsupported
+		}
+	}
+	if ee.ttl > 0 {
+		withExpiry := *ops
+		withExpiry.SetOnInsert = make(map[string]interface{}, len(ops.SetOnInsert)+1)
+		for k, v := range ops.SetOnInsert {
+			withExpiry.SetOnInsert[k] = v
+		}
+		withExpiry.SetOnInsert[ee.property] = time.Now().Add(ee.ttl).UTC().Format(time.RFC3339Nano)
+		ops = &withExpiry
+	}
+	return update(ee.engine, id, ops)
+}
+
+func (ee *expiryEngine) Read(id string) (interface{}, bool, error) {
+	doc, found, err := ee.engine.Read(id)
+	if err != nil || !found {
+		return doc, found, err
+	}
+	if expired(doc.(Document), ee.property, time.Now()) {
+		return nil, false, nil
+	}
+	return doc, true, nil
+}
+
+func (ee *expiryEngine) Documents(f func(Document) (bool, error)) error {
+	now := time.Now()
+	return forEachDocument(ee.engine, 0, func(doc Document) (bool, error) {
+		if expired(doc, ee.property, now) {
+			return true, nil
+		}
+		return f(doc)
+	})
+}
+
+func (ee *expiryEngine) reapLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ee.stop:
+			return
+		case <-ticker.C:
+			ee.reap()
+		}
+	}
+}
+
+func (ee *expiryEngine) reap() {
+	n, err := deleteExpired(ee.engine, ee.property, time.Now())
+	if err != nil {
+		log.Printf("%s: deleting expired documents failed: %v\n", ee.name, err)
+	}
+	if n > 0 {
+		log.Printf("%s: deleted %d expired documents\n", ee.name, n)
+	}
+}
+
+// deleteExpired deletes the documents in a collection that expired by now,
+// natively if the engine is an Expirer and otherwise by reading every
+// document. Wrappers that don't change stored documents are Expirers that
+// forward to the engine they wrap.
+func deleteExpired(coll Engine, property string, now time.Time) (int, error) {
+	if ex, ok := coll.(Expirer); ok {
+		return ex.DeleteExpired(property, now)
+	}
+
+	var ids []string
+	err := forEachDocument(coll, 8, func(doc Document) (bool, error) {
+		if expired(doc, property, now) {
+			if id, ok := documentID(coll.IDPropertyName(), doc); ok {
+				ids = append(ids, id)
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		found, err := coll.Delete(id)
+		if err != nil {
+			return deleted, err
+		}
+		if found {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (ee *expiryEngine) Delete(id string) (bool, error) {
+	return ee.engine.Delete(id)
+}
+
+func (ee *expiryEngine) Drop() (bool, error) {
+	return ee.engine.Drop()
+}
+
+func (ee *expiryEngine) Count() (int, error) {
+	return ee.engine.Count()
+}
+
+func (ee *expiryEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return ee.engine.IDs(f)
+}
+
+func (ee *expiryEngine) Unwrap() Engine {
+	return ee.engine
+}
+
+func (ee *expiryEngine) IDPropertyName() string {
+	return ee.engine.IDPropertyName()
+}
+
+func (ee *expiryEngine) Initialise() error {
+	return ee.engine.Initialise()
+}
+
+func (ee *expiryEngine) Check() error {
+	return ee.engine.Check()
+}
+
+func (ee *expiryEngine) Close() {
+	close(ee.stop)
+	ee.engine.Close()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/pborman/uuid"
+)
+
+// IDRules constrain and normalise a collection's ids. Ids are always trimmed
+// of surrounding whitespace, and lowercased if Lowercase is set, before being
+// checked.
+type IDRules struct {
+	// Format is "uuid" to only accept uuids, or empty for any format.
+	Format string `json:"format"`
+	// Versions limits the uuid versions accepted, e.g. [3, 4]. Any version
+	// is accepted if it's empty.
+	Versions  []int  `json:"versions"`
+	Pattern   string `json:"pattern"`
+	MaxLength int    `json:"maxLength"`
+	Lowercase bool   `json:"lowercase"`
+
+	pattern *regexp.Regexp
+}
+
+func (rules *IDRules) compile() error {
+	if rules.Format != "" && rules.Format != "uuid" {
+		return fmt.Errorf("unknown id format %s", rules.Format)
+	}
+	if rules.Pattern != "" {
+		var err error
+		if rules.pattern, err = regexp.Compile(rules.Pattern); err != nil {
+			return fmt.Errorf("invalid id pattern: %v", err)
+		}
+	}
+	return nil
+}
+
+// normalise returns the normalised form of an id, or an error if it breaks
+// the rules.
+func (rules *IDRules) normalise(id string) (string, error) {
+	id = strings.TrimSpace(id)
+	if rules.Lowercase {
+		id = strings.ToLower(id)
+	}
+
+	if id == "" {
+		return "", fmt.Errorf("empty id")
+	}
+	if rules.MaxLength > 0 && len(id) > rules.MaxLength {
+		return "", fmt.Errorf("id %s is longer than %d characters", id, rules.MaxLength)
+	}
+	if rules.Format == "uuid" {
+		u := uuid.Parse(id)
+		if u == nil || len(id) != 36 {
+			return "", fmt.Errorf("id %s is not a uuid", id)
+		}
+		if version, _ := u.Version(); len(rules.Versions) > 0 && !containsVersion(rules.Versions, int(version)) {
+			return "", fmt.Errorf("id %s is a version %d uuid, expected version %v", id, version, rules.Versions)
+		}
+	}
+	if rules.pattern != nil && !rules.pattern.MatchString(id) {
+		return "", fmt.Errorf("id %s doesn't match %s", id, rules.Pattern)
+	}
+	return id, nil
+}
+
+func containsVersion(versions []int, v int) bool {
+	for _, version := range versions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// idRulesEngine normalises and checks ids in decoded documents, reads and
+// deletes.
+type idRulesEngine struct {
+	engine Engine
+	rules  *IDRules
+}
+
+// NewIDRulesEngine returns an Engine that applies id rules to e.
+func NewIDRulesEngine(e Engine, rules IDRules) (Engine, error) {
+	if err := rules.compile(); err != nil {
+		return nil, err
+	}
+	return &idRulesEngine{engine: e, rules: &rules}, nil
+}
+
+// idRulesEngines wraps each engine whose collection has id rules configured.
+func idRulesEngines(engines map[string]Engine, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	wrapped := make(map[string]Engine)
+	for name, e := range engines {
+		if rules := collections[name].IDRules; rules != nil {
+			var err error
+			if e, err = NewIDRulesEngine(e, *rules); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		wrapped[name] = e
+	}
+	return wrapped, nil
+}
+
+// normaliseID applies a collection's id rules, if it has any, to an id.
+func normaliseID(coll Engine, id string) (string, error) {
+	for _, e := range engineChain(coll) {
+		if ie, ok := e.(*idRulesEngine); ok {
+			return ie.rules.normalise(id)
+		}
+	}
+	return id, nil
+}
+
+func (ie *idRulesEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	resource, id, err := ie.engine.DecodeJSON(dec)
+	if err != nil {
+		return resource, id, err
+	}
+	if id, err = ie.rules.normalise(id); err != nil {
+		return nil, "", err
+	}
+	if doc, ok := resource.(Document); ok {
+		if err := setDocumentID(ie.engine.IDPropertyName(), doc, id); err != nil {
+			return nil, "", err
+		}
+	}
+	return resource, id, nil
+}
+
+// Read treats ids that break the rules as not found.
+func (ie *idRulesEngine) Read(id string) (interface{}, bool, error) {
+	id, err := ie.rules.normalise(id)
+	if err != nil {
+		return nil, false, nil
+	}
+	return ie.engine.Read(id)
+}
+
+func (ie *idRulesEngine) Delete(id string) (bool, error) {
+	id, err := ie.rules.normalise(id)
+	if err != nil {
+		return false, nil
+	}
+	return ie.engine.Delete(id)
+}
+
+func (ie *idRulesEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	id, err := ie.rules.normalise(id)
+	if err != nil {
+		return nil, false, &opsError{err}
+	}
+	return update(ie.engine, id, ops)
+}
+
+// ApplyBatch expects the batch's ids to have been normalised, as they are
+// when its documents are decoded.
+func (ie *idRulesEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	return applyBatch(ie.engine, ops)
+}
+
+func (ie *idRulesEngine) Write(resource interface{}) error {
+	return ie.engine.Write(resource)
+}
+
+func (ie *idRulesEngine) Drop() (bool, error) {
+	return ie.engine.Drop()
+}
+
+func (ie *idRulesEngine) Count() (int, error) {
+	return ie.engine.Count()
+}
+
+func (ie *idRulesEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return ie.engine.IDs(f)
+}
+
+func (ie *idRulesEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(ie.engine, 0, f)
+}
+
+// DeleteExpired lets expired documents be deleted natively by the wrapped
+// engine.
+func (ie *idRulesEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	return deleteExpired(ie.engine, property, now)
+}
+
+func (ie *idRulesEngine) Unwrap() Engine {
+	return ie.engine
+}
+
+func (ie *idRulesEngine) IDPropertyName() string {
+	return ie.engine.IDPropertyName()
+}
+
+func (ie *idRulesEngine) Initialise() error {
+	return ie.engine.Initialise()
+}
+
+func (ie *idRulesEngine) Check() error {
+	return ie.engine.Check()
+}
+
+func (ie *idRulesEngine) Close() {
+	ie.engine.Close()
+}
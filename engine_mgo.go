@@ -5,37 +5,99 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
-	"github.com/kr/pretty"
 	"github.com/pborman/uuid"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 type mongoEngine struct {
-	session        *mgo.Session
-	dbName         string
-	collectionName string
-	idPropertyName string
-	isBinaryId     bool
+	session              *mgo.Session
+	dbName               string
+	collectionName       string
+	idPropertyName       string
+	idKey                *idKey
+	isBinaryId           bool
+	binaryIDFormat       string
+	compression          string
+	compressionThreshold int
+	expiryProperty       string
 }
 
+// MongoOptions configure how a mongodb engine stores documents.
+type MongoOptions struct {
+	// BinaryID is true if the id property is stored as a binary uuid.
+	BinaryID bool
+	// BinaryIDFormat is how binary uuids are stored: "standard" (subtype
+	// 0x04, the default), "legacy" (subtype 0x03 in the same byte order) or
+	// "java-legacy" (subtype 0x03 in the legacy java driver's byte order).
+	BinaryIDFormat string
+	// Compression is the algorithm used to compress large top level fields:
+	// snappy, zstd or empty for none.
+	Compression string
+	// CompressionThreshold is the size in bytes of a field's json encoding
+	// above which it is compressed. Defaults to 1024.
+	CompressionThreshold int
+	// ExpiryProperty, if set, is stored as a date with a TTL index, so that
+	// mongodb deletes documents once it has passed.
+	ExpiryProperty string
+}
+
+// mongoCompressedKind is the user defined bson binary subtype that holds a
+// compressed field.
+const mongoCompressedKind = 0x80
+
+// bson binary subtypes for uuids.
+const (
+	mongoLegacyUUIDKind   = 0x03
+	mongoStandardUUIDKind = 0x04
+)
+
+var binaryIDFormats = map[string]bool{"standard": true, "legacy": true, "java-legacy": true}
+
 func (eng mongoEngine) Close() {
 	// TODO
 }
 
 // NewMongoEngine returns an Engine based on a mongodb database backend
-func NewMongoEngine(dbName string, collectionName string, idPropertyName string, isBinaryId bool, s *mgo.Session) Engine {
+func NewMongoEngine(dbName string, collectionName string, idPropertyName string, opts MongoOptions, s *mgo.Session) (Engine, error) {
+	if err := checkCompression(opts.Compression); err != nil {
+		return nil, err
+	}
+	if opts.CompressionThreshold == 0 {
+		opts.CompressionThreshold = 1024
+	}
+	if opts.BinaryIDFormat == "" {
+		opts.BinaryIDFormat = "standard"
+	}
+	if !binaryIDFormats[opts.BinaryIDFormat] {
+		return nil, fmt.Errorf("unknown binary id format %s", opts.BinaryIDFormat)
+	}
+	key, err := parseIDKey(idPropertyName)
+	if err != nil {
+		return nil, err
+	}
+	if opts.BinaryID && (!key.simple() || strings.Contains(idPropertyName, ".")) {
+		return nil, errors.New("binary ids need a single top level id property")
+	}
+
 	eng := &mongoEngine{
-		session:        s,
-		dbName:         dbName,
-		collectionName: collectionName,
-		idPropertyName: idPropertyName,
-		isBinaryId:     isBinaryId,
+		session:              s,
+		dbName:               dbName,
+		collectionName:       collectionName,
+		idPropertyName:       idPropertyName,
+		idKey:                key,
+		isBinaryId:           opts.BinaryID,
+		binaryIDFormat:       opts.BinaryIDFormat,
+		compression:          opts.Compression,
+		compressionThreshold: opts.CompressionThreshold,
+		expiryProperty:       opts.ExpiryProperty,
 	}
 
-	return eng
+	return eng, nil
 }
 
 func (eng *mongoEngine) Initialise() error {
@@ -46,13 +108,27 @@ func (eng *mongoEngine) Initialise() error {
 	// create collection if it's not there
 	c.Create(&mgo.CollectionInfo{})
 
-	return c.EnsureIndex(mgo.Index{
-		Key:        []string{eng.idPropertyName},
+	var key []string
+	for _, field := range eng.idKey.fields {
+		key = append(key, field.path)
+	}
+	err := c.EnsureIndex(mgo.Index{
+		Key:        key,
 		Unique:     true,
 		DropDups:   true,
 		Background: false,
 		Sparse:     false,
 	})
+	if err != nil || eng.expiryProperty == "" {
+		return err
+	}
+
+	// mongodb checks for expired documents every minute or so, so this is
+	// only a backstop to DeleteExpired
+	return c.EnsureIndex(mgo.Index{
+		Key:         []string{eng.expiryProperty},
+		ExpireAfter: time.Second,
+	})
 }
 
 func (eng *mongoEngine) Drop() (bool, error) {
@@ -67,19 +143,29 @@ func (eng *mongoEngine) Drop() (bool, error) {
 
 func (eng *mongoEngine) Write(resource interface{}) error {
 	cont := resource.(Document)
-	id, ok := cont[eng.idPropertyName].(string)
-	if !ok || id == "" {
+	id, ok := documentID(eng.idPropertyName, cont)
+	if !ok {
 		return errors.New("missing or invalid id")
 	}
 	coll := eng.session.DB(eng.dbName).C(eng.collectionName)
-	if id == "" {
-		return errors.New("missing id")
+	query, err := eng.idQuery(id)
+	if err != nil {
+		return err
 	}
-	_, err := coll.Upsert(bson.D{{eng.idPropertyName, id}}, cont)
+	cont, err = eng.compressFields(eng.storeExpiry(cont))
 	if err != nil {
-		log.Printf("insert failed: %v\n", err)
+		return err
 	}
-	return nil
+	if eng.isBinaryId {
+		stored := make(Document, len(cont))
+		for k, v := range cont {
+			stored[k] = v
+		}
+		stored[eng.idPropertyName] = query[eng.idPropertyName]
+		cont = stored
+	}
+	_, err = coll.Upsert(query, cont)
+	return err
 }
 
 func (eng *mongoEngine) Count() (int, error) {
@@ -90,14 +176,12 @@ func (eng *mongoEngine) Read(id string) (interface{}, bool, error) {
 	c := eng.session.DB(eng.dbName).C(eng.collectionName)
 	var content Document
 
-	var err error
-	if eng.isBinaryId {
-		binaryId := bson.Binary{Kind: 0x04, Data: []byte(uuid.Parse(id))}
-		err = c.Find(bson.M{eng.idPropertyName: binaryId}).One(&content)
-	} else {
-		err = c.Find(bson.M{eng.idPropertyName: id}).One(&content)
+	query, err := eng.idQuery(id)
+	if err != nil {
+		// no document can have an invalid id
+		return nil, false, nil
 	}
-
+	err = c.Find(query).One(&content)
 	if err == mgo.ErrNotFound {
 		return nil, false, nil
 	}
@@ -105,15 +189,23 @@ func (eng *mongoEngine) Read(id string) (interface{}, bool, error) {
 		return nil, false, err
 	}
 	cleanup(content)
-	if eng.isBinaryId {
-		content[eng.idPropertyName] = id
+	if err := eng.loadID(content); err != nil {
+		return nil, false, err
 	}
+	if err := decompressFields(content); err != nil {
+		return nil, false, err
+	}
+	eng.loadExpiry(content)
 	return content, true, nil
 }
 
 func (eng *mongoEngine) Delete(id string) (bool, error) {
 	c := eng.session.DB(eng.dbName).C(eng.collectionName)
-	err := c.Remove(bson.M{eng.idPropertyName: id})
+	query, err := eng.idQuery(id)
+	if err != nil {
+		return false, nil
+	}
+	err = c.Remove(query)
 	if err != nil {
 		if err == mgo.ErrNotFound {
 			return false, nil
@@ -123,19 +215,144 @@ func (eng *mongoEngine) Delete(id string) (bool, error) {
 	return true, nil
 }
 
+// Update applies operations with mongodb's update operators. Compressed
+// fields can't be changed in place, so collections with compression can't be
+// updated natively.
+func (eng *mongoEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	if eng.compression != "" {
+		return nil, false, errUpdateUnsupported
+	}
+	query, err := eng.idQuery(id)
+	if err != nil {
+		return nil, false, &opsError{err}
+	}
+	c := eng.session.DB(eng.dbName).C(eng.collectionName)
+	var doc Document
+	info, err := c.Find(query).Apply(mgo.Change{Update: eng.updateOperators(ops), Upsert: true, ReturnNew: true}, &doc)
+	switch err.(type) {
+	case nil:
+	case *mgo.QueryError, *mgo.LastError:
+		// the operations don't apply to the document
+		return nil, false, &opsError{err}
+	default:
+		return nil, false, err
+	}
+	cleanup(doc)
+	if err := eng.loadID(doc); err != nil {
+		return nil, false, err
+	}
+	eng.loadExpiry(doc)
+	return doc, info.Updated == 0, nil
+}
+
+// updateOperators returns the update operators applying ops. An expiry time
+// set on insert is stored as a date, as it is when written, so that the TTL
+// index and DeleteExpired find it.
+func (eng *mongoEngine) updateOperators(ops *Operations) bson.M {
+	update := bson.M{}
+	for name, fields := range ops.byOperator() {
+		if len(fields) == 0 {
+			continue
+		}
+		if name == "setOnInsert" {
+			fields = eng.storeExpiry(fields)
+		}
+		update["$"+name] = fields
+	}
+	return update
+}
+
 func (eng mongoEngine) IDs(f func(id rwapi.IDEntry) (bool, error)) error {
 	coll := eng.session.DB(eng.dbName).C(eng.collectionName)
-	iter := coll.Find(nil).Select(bson.M{eng.idPropertyName: true}).Iter()
+	selector := bson.M{}
+	for _, field := range eng.idKey.fields {
+		selector[field.path] = true
+	}
+	iter := coll.Find(nil).Select(selector).Iter()
 	var result map[string]interface{}
 	for iter.Next(&result) {
-		more, err := f(rwapi.IDEntry{ID: getUUIDString(result[eng.idPropertyName])})
+		if err := eng.loadID(result); err != nil {
+			iter.Close()
+			return err
+		}
+		id, ok := documentID(eng.idPropertyName, result)
+		if !ok {
+			iter.Close()
+			return fmt.Errorf("document without a valid id in %s", eng.collectionName)
+		}
+		more, err := f(rwapi.IDEntry{ID: id})
 		if !more || err != nil {
+			iter.Close()
 			return err
 		}
 	}
 	return iter.Close()
 }
 
+func (eng mongoEngine) Documents(f func(Document) (bool, error)) error {
+	coll := eng.session.DB(eng.dbName).C(eng.collectionName)
+	// iterating in _id order, over the _id index, stops documents that move
+	// during the iteration from being returned twice, which the $snapshot
+	// modifier did before mongodb 4.0 removed it
+	iter := coll.Find(nil).Sort("_id").Iter()
+	var doc Document
+	for iter.Next(&doc) {
+		cleanup(doc)
+		if err := eng.loadID(doc); err != nil {
+			iter.Close()
+			return err
+		}
+		if err := decompressFields(doc); err != nil {
+			iter.Close()
+			return err
+		}
+		eng.loadExpiry(doc)
+		more, err := f(doc)
+		if !more || err != nil {
+			iter.Close()
+			return err
+		}
+		doc = nil
+	}
+	return iter.Close()
+}
+
+// storeExpiry returns a copy of the document with its expiry time as a date,
+// which the TTL index requires.
+func (eng *mongoEngine) storeExpiry(doc Document) Document {
+	if eng.expiryProperty == "" {
+		return doc
+	}
+	t, ok := expiryTime(doc, eng.expiryProperty)
+	if !ok {
+		return doc
+	}
+	out := make(Document, len(doc))
+	for k, v := range doc {
+		out[k] = v
+	}
+	out[eng.expiryProperty] = t
+	return out
+}
+
+// loadExpiry turns a stored expiry date back into an RFC 3339 string.
+func (eng *mongoEngine) loadExpiry(doc Document) {
+	if t, ok := doc[eng.expiryProperty].(time.Time); ok && eng.expiryProperty != "" {
+		doc[eng.expiryProperty] = t.UTC().Format(time.RFC3339Nano)
+	}
+}
+
+// DeleteExpired deletes the documents that expired by now, using the TTL
+// index.
+func (eng *mongoEngine) DeleteExpired(property string, now time.Time) (int, error) {
+	c := eng.session.DB(eng.dbName).C(eng.collectionName)
+	info, err := c.RemoveAll(bson.M{property: bson.M{"$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
 func (ee mongoEngine) IDPropertyName() string {
 	return ee.idPropertyName
 }
@@ -146,7 +363,7 @@ func (ee mongoEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error)
 		return nil, "", err
 	}
 
-	id, ok := doc[ee.idPropertyName].(string)
+	id, ok := documentID(ee.idPropertyName, doc)
 	if !ok {
 		return nil, "", errors.New("no id found in document")
 	}
@@ -158,15 +375,156 @@ func (ee mongoEngine) Check() error {
 	return errors.New("check not implemented")
 }
 
-func getUUIDString(uuidValue interface{}) string {
-	if uuidString, ok := uuidValue.(string); ok {
-		return uuidString
-	} else if binaryId, ok := uuidValue.(bson.Binary); ok {
-		return uuid.UUID(binaryId.Data).String()
-	} else {
-		fmt.Printf("UUID field is in an unknown format!\n %# v", pretty.Formatter(uuidValue))
-		return ""
+// idQuery returns the query that selects the document with an id.
+func (eng *mongoEngine) idQuery(id string) (bson.M, error) {
+	if eng.isBinaryId {
+		value, err := eng.idValue(id)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{eng.idPropertyName: value}, nil
+	}
+	values, err := eng.idKey.values(id)
+	if err != nil {
+		return nil, err
+	}
+	query := bson.M{}
+	for i, field := range eng.idKey.fields {
+		query[field.path] = values[i]
+	}
+	return query, nil
+}
+
+// loadID turns a stored top level id back into a string, since binary ids
+// may be stored in collections that weren't configured for them.
+func (eng *mongoEngine) loadID(doc map[string]interface{}) error {
+	if !eng.idKey.simple() || strings.Contains(eng.idPropertyName, ".") {
+		return nil
+	}
+	v, found := doc[eng.idPropertyName]
+	if !found {
+		return nil
 	}
+	id, err := eng.idString(v)
+	if err != nil {
+		return err
+	}
+	doc[eng.idPropertyName] = id
+	return nil
+}
+
+// isIDProperty reports whether a top level property holds all or part of the
+// id.
+func (eng *mongoEngine) isIDProperty(name string) bool {
+	for _, field := range eng.idKey.fields {
+		if strings.SplitN(field.path, ".", 2)[0] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// idValue returns the value an id is stored as.
+func (eng *mongoEngine) idValue(id string) (interface{}, error) {
+	if !eng.isBinaryId {
+		return id, nil
+	}
+	u := uuid.Parse(id)
+	if u == nil {
+		return nil, fmt.Errorf("id %s is not a uuid", id)
+	}
+	switch eng.binaryIDFormat {
+	case "legacy":
+		return bson.Binary{Kind: mongoLegacyUUIDKind, Data: []byte(u)}, nil
+	case "java-legacy":
+		return bson.Binary{Kind: mongoLegacyUUIDKind, Data: javaLegacyOrder(u)}, nil
+	default:
+		return bson.Binary{Kind: mongoStandardUUIDKind, Data: []byte(u)}, nil
+	}
+}
+
+// idString returns the string form of a stored id. Binary uuids of either
+// subtype are read, whatever the configured format.
+func (eng *mongoEngine) idString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bson.Binary:
+		if len(v.Data) != 16 {
+			return "", fmt.Errorf("binary id of %d bytes is not a uuid", len(v.Data))
+		}
+		switch {
+		case v.Kind == mongoStandardUUIDKind:
+			return uuid.UUID(v.Data).String(), nil
+		case v.Kind == mongoLegacyUUIDKind && eng.binaryIDFormat == "java-legacy":
+			return uuid.UUID(javaLegacyOrder(v.Data)).String(), nil
+		case v.Kind == mongoLegacyUUIDKind:
+			return uuid.UUID(v.Data).String(), nil
+		}
+		return "", fmt.Errorf("binary id has unsupported subtype 0x%02x", v.Kind)
+	default:
+		return "", fmt.Errorf("id %v has unsupported type %T", value, value)
+	}
+}
+
+// javaLegacyOrder converts between the standard byte order of a uuid and the
+// legacy java driver's, which reverses each half.
+func javaLegacyOrder(data []byte) []byte {
+	out := make([]byte, 16)
+	for i := 0; i < 8; i++ {
+		out[i] = data[7-i]
+		out[8+i] = data[15-i]
+	}
+	return out
+}
+
+// compressFields returns a copy of the document in which every top level
+// field, other than the id, whose json encoding is larger than the threshold is
+// replaced by its compressed json encoding.
+func (eng *mongoEngine) compressFields(doc Document) (Document, error) {
+	if eng.compression == "" {
+		return doc, nil
+	}
+	out := make(Document, len(doc))
+	for k, v := range doc {
+		out[k] = v
+		if eng.isIDProperty(k) {
+			continue
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) <= eng.compressionThreshold {
+			continue
+		}
+		if data, err = compress(eng.compression, data); err != nil {
+			return nil, err
+		}
+		out[k] = bson.Binary{Kind: mongoCompressedKind, Data: data}
+	}
+	return out, nil
+}
+
+// decompressFields replaces any compressed fields in the document with their
+// original values.
+func decompressFields(doc Document) error {
+	for k, v := range doc {
+		bin, ok := v.(bson.Binary)
+		if !ok || bin.Kind != mongoCompressedKind {
+			continue
+		}
+		data, err := decompress(bin.Data)
+		if err != nil {
+			return fmt.Errorf("failed to decompress field %s: %v", k, err)
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return fmt.Errorf("failed to decode field %s: %v", k, err)
+		}
+		doc[k] = value
+	}
+	return nil
 }
 
 func cleanup(doc Document) {
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestMongoBinaryIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	id := "00112233-4455-6677-8899-aabbccddeeff"
+	for format, expected := range map[string]bson.Binary{
+		"standard":    {Kind: 0x04, Data: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}},
+		"legacy":      {Kind: 0x03, Data: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}},
+		"java-legacy": {Kind: 0x03, Data: []byte{0x77, 0x66, 0x55, 0x44, 0x33, 0x22, 0x11, 0x00, 0xff, 0xee, 0xdd, 0xcc, 0xbb, 0xaa, 0x99, 0x88}},
+	} {
+		e, err := NewMongoEngine("db", "coll", "uuid", MongoOptions{BinaryID: true, BinaryIDFormat: format}, nil)
+		assert.NoError(err)
+		eng := e.(*mongoEngine)
+
+		value, err := eng.idValue(id)
+		assert.NoError(err)
+		assert.Equal(expected, value, format)
+		read, err := eng.idString(value)
+		assert.NoError(err)
+		assert.Equal(id, read, format)
+
+		_, err = eng.idValue("not-a-uuid")
+		assert.Error(err)
+	}
+
+	e, err := NewMongoEngine("db", "coll", "uuid", MongoOptions{}, nil)
+	assert.NoError(err)
+	eng := e.(*mongoEngine)
+	_, err = eng.idString(bson.Binary{Kind: 0x00, Data: make([]byte, 16)})
+	assert.Error(err)
+	_, err = eng.idString(42)
+	assert.Error(err)
+
+	_, err = NewMongoEngine("db", "coll", "uuid", MongoOptions{BinaryID: true, BinaryIDFormat: "csharp"}, nil)
+	assert.Error(err)
+}
+
+func TestMongoIDQueries(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := NewMongoEngine("db", "coll", "{authority}:{code:number}", MongoOptions{}, nil)
+	assert.NoError(err)
+	eng := e.(*mongoEngine)
+
+	query, err := eng.idQuery("FT-TME:42")
+	assert.NoError(err)
+	assert.Equal(bson.M{"authority": "FT-TME", "code": float64(42)}, query)
+	_, err = eng.idQuery("FT-TME:x")
+	assert.Error(err)
+	assert.True(eng.isIDProperty("code"))
+	assert.False(eng.isIDProperty("name"))
+
+	_, err = NewMongoEngine("db", "coll", "meta.uuid", MongoOptions{BinaryID: true}, nil)
+	assert.Error(err)
+}
+
+func TestMongoUpdateOperators(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := NewMongoEngine("db", "coll", "uuid", MongoOptions{ExpiryProperty: "expiresAt"}, nil)
+	assert.NoError(err)
+	eng := e.(*mongoEngine)
+
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	update := eng.updateOperators(&Operations{
+		Inc:         map[string]interface{}{"n": float64(1)},
+		SetOnInsert: map[string]interface{}{"expiresAt": expires.Format(time.RFC3339Nano), "meta.created": "now"},
+	})
+	assert.Equal(bson.M{
+		"$inc":         map[string]interface{}{"n": float64(1)},
+		"$setOnInsert": map[string]interface{}{"expiresAt": expires, "meta.created": "now"},
+	}, update)
+
+	// so the TTL index and DeleteExpired's date query match upserted documents
+	_, isDate := update["$setOnInsert"].(map[string]interface{})["expiresAt"].(time.Time)
+	assert.True(isDate)
+}
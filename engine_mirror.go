@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/gorilla/mux"
+)
+
+// mirrorEngine writes to a primary and a secondary engine, and reads from the
+// primary. Writes only fail if the primary fails. Secondary failures are
+// queued and retried in the background by copying the primary's current state
+// for the affected ids, so the secondary converges on the primary however the
+// retries and later writes interleave.
+//
+// The retry queue is held in memory. After a restart, use diff to find and
+// repair any divergence that was still queued.
+type mirrorEngine struct {
+	primary   Engine
+	secondary Engine
+	name      string
+
+	mu          sync.Mutex
+	pending     map[string]bool
+	pendingDrop bool
+	stop        chan struct{}
+
+	// locks serialises the writes, deletes and retries of each id, so that
+	// a retry can neither overwrite a newer write with what it read from the
+	// primary, nor stop retrying an id that failed again meanwhile.
+	locks *keyedMutex
+}
+
+// NewMirrorEngine returns an Engine that mirrors writes from primary to
+// secondary, retrying failed secondary writes every retryInterval.
+func NewMirrorEngine(name string, primary Engine, secondary Engine, retryInterval time.Duration) Engine {
+	me := &mirrorEngine{
+		primary:   primary,
+		secondary: secondary,
+		name:      name,
+		pending:   make(map[string]bool),
+		stop:      make(chan struct{}),
+		locks:     newKeyedMutex(),
+	}
+	go me.retryLoop(retryInterval)
+	return me
+}
+
+func (me *mirrorEngine) Write(resource interface{}) error {
+	doc, _ := resource.(Document)
+	id, _ := documentID(me.primary.IDPropertyName(), doc)
+	defer me.locks.lock(id)()
+	if err := me.primary.Write(resource); err != nil {
+		return err
+	}
+	if err := me.secondary.Write(resource); err != nil {
+		me.diverged(id, err)
+	}
+	return nil
+}
+
+func (me *mirrorEngine) Delete(id string) (bool, error) {
+	defer me.locks.lock(id)()
+	deleted, err := me.primary.Delete(id)
+	if err != nil {
+		return deleted, err
+	}
+	if _, err := me.secondary.Delete(id); err != nil {
+		me.diverged(id, err)
+	}
+	return deleted, nil
+}
+
+func (me *mirrorEngine) Drop() (bool, error) {
+	dropped, err := me.primary.Drop()
+	if err != nil {
+		return dropped, err
+	}
+	if _, err := me.secondary.Drop(); err != nil {
+		log.Printf("%s: secondary drop failed, will retry: %v\n", me.name, err)
+		me.mu.Lock()
+		me.pendingDrop = true
+		me.mu.Unlock()
+	}
+	return dropped, nil
+}
+
+// diverged queues an id whose secondary write failed.
+func (me *mirrorEngine) diverged(id string, err error) {
+	log.Printf("%s: secondary failed for %s, will retry: %v\n", me.name, id, err)
+	me.mu.Lock()
+	me.pending[id] = true
+	me.mu.Unlock()
+}
+
+func (me *mirrorEngine) retryLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-me.stop:
+			return
+		case <-ticker.C:
+			me.retry()
+		}
+	}
+}
+
+func (me *mirrorEngine) retry() {
+	me.mu.Lock()
+	drop := me.pendingDrop
+	ids := make([]string, 0, len(me.pending))
+	for id := range me.pending {
+		ids = append(ids, id)
+	}
+	me.mu.Unlock()
+
+	// Writes mirrored since the failed drop are lost by dropping now, so
+	// every id in the primary is queued for syncing afterwards.
+	if drop {
+		if _, err := me.secondary.Drop(); err != nil {
+			log.Printf("%s: retrying secondary drop failed: %v\n", me.name, err)
+			return
+		}
+		ids = ids[:0]
+		err := me.primary.IDs(func(id rwapi.IDEntry) (bool, error) {
+			ids = append(ids, id.ID)
+			return true, nil
+		})
+		me.mu.Lock()
+		me.pendingDrop = false
+		for _, id := range ids {
+			me.pending[id] = true
+		}
+		me.mu.Unlock()
+		if err != nil {
+			log.Printf("%s: listing primary ids after drop failed: %v\n", me.name, err)
+		}
+	}
+
+	for _, id := range ids {
+		if err := me.sync(id); err != nil {
+			log.Printf("%s: retrying %s failed: %v\n", me.name, id, err)
+		}
+	}
+}
+
+// sync copies the primary's current state for an id to the secondary, and
+// stops retrying it if that succeeds.
+func (me *mirrorEngine) sync(id string) error {
+	defer me.locks.lock(id)()
+	doc, found, err := me.primary.Read(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		_, err = me.secondary.Delete(id)
+	} else {
+		var decoded interface{}
+		if decoded, _, err = decodeDocument(me.secondary, doc.(Document)); err == nil {
+			err = me.secondary.Write(decoded)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	me.mu.Lock()
+	delete(me.pending, id)
+	me.mu.Unlock()
+	return nil
+}
+
+// Pending returns the ids still waiting to be written to the secondary, and
+// whether a drop of the secondary is waiting too.
+func (me *mirrorEngine) Pending() ([]string, bool) {
+	me.mu.Lock()
+	defer me.mu.Unlock()
+	ids := make([]string, 0, len(me.pending))
+	for id := range me.pending {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, me.pendingDrop
+}
+
+func (me *mirrorEngine) Read(id string) (interface{}, bool, error) {
+	return me.primary.Read(id)
+}
+
+func (me *mirrorEngine) Count() (int, error) {
+	return me.primary.Count()
+}
+
+func (me *mirrorEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return me.primary.IDs(f)
+}
+
+func (me *mirrorEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(me.primary, 0, f)
+}
+
+func (me *mirrorEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	return me.primary.DecodeJSON(dec)
+}
+
+func (me *mirrorEngine) IDPropertyName() string {
+	return me.primary.IDPropertyName()
+}
+
+func (me *mirrorEngine) Initialise() error {
+	if err := me.primary.Initialise(); err != nil {
+		return err
+	}
+	return me.secondary.Initialise()
+}
+
+func (me *mirrorEngine) Check() error {
+	if err := me.primary.Check(); err != nil {
+		return fmt.Errorf("primary: %v", err)
+	}
+	if err := me.secondary.Check(); err != nil {
+		return fmt.Errorf("secondary: %v", err)
+	}
+	return nil
+}
+
+func (me *mirrorEngine) Close() {
+	close(me.stop)
+	me.primary.Close()
+	me.secondary.Close()
+}
+
+// mirrorEngineOf returns the mirror engine within a collection's wrappers, if
+// it has one.
+func mirrorEngineOf(coll Engine) (*mirrorEngine, bool) {
+	for _, e := range engineChain(coll) {
+		if me, ok := e.(*mirrorEngine); ok {
+			return me, true
+		}
+	}
+	return nil, false
+}
+
+// mirrorHandler reports the writes still waiting to be retried on a mirrored
+// collection's secondary.
+func (ah *apiHandlers) mirrorHandler(w http.ResponseWriter, r *http.Request) {
+	coll, err := ah.getCollection(mux.Vars(r)["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	me, ok := mirrorEngineOf(coll)
+	if !ok {
+		http.Error(w, "collection isn't mirrored", http.StatusNotFound)
+		return
+	}
+
+	ids, drop := me.Pending()
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pending":     ids,
+		"pendingDrop": drop,
+	})
+}
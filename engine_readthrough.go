@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+)
+
+// readThroughEngine moves a collection from an old backend to a new one
+// lazily. Reads are served from the new backend, falling back to the old one
+// and copying the document across on a miss. Writes only go to the new
+// backend, and deletes go to both so that deleted documents don't reappear
+// from the old one. Listing and counting merge the two.
+type readThroughEngine struct {
+	newer Engine
+	older Engine
+	name  string
+
+	// locks serialises copying each id across with writes and deletes of
+	// it, so that a copy can neither overwrite a newer write nor bring back a
+	// deleted document.
+	locks *keyedMutex
+}
+
+// NewReadThroughEngine returns an Engine that migrates documents from older to
+// newer as they are read.
+func NewReadThroughEngine(name string, newer Engine, older Engine) Engine {
+	return &readThroughEngine{newer: newer, older: older, name: name, locks: newKeyedMutex()}
+}
+
+func (re *readThroughEngine) Read(id string) (interface{}, bool, error) {
+	doc, found, err := re.newer.Read(id)
+	if err != nil || found {
+		return doc, found, err
+	}
+
+	// read the new backend again under the lock, in case the document was
+	// written meanwhile
+	defer re.locks.lock(id)()
+	if doc, found, err = re.newer.Read(id); err != nil || found {
+		return doc, found, err
+	}
+	doc, found, err = re.older.Read(id)
+	if err != nil || !found {
+		return doc, found, err
+	}
+	if err := re.copy(doc.(Document)); err != nil {
+		log.Printf("%s: copying %s to the new backend failed: %v\n", re.name, id, err)
+	}
+	return doc, true, nil
+}
+
+func (re *readThroughEngine) copy(doc Document) error {
+	decoded, _, err := decodeDocument(re.newer, doc)
+	if err != nil {
+		return err
+	}
+	return re.newer.Write(decoded)
+}
+
+func (re *readThroughEngine) Write(resource interface{}) error {
+	doc, _ := resource.(Document)
+	id, _ := documentID(re.newer.IDPropertyName(), doc)
+	defer re.locks.lock(id)()
+	return re.newer.Write(resource)
+}
+
+func (re *readThroughEngine) Delete(id string) (bool, error) {
+	defer re.locks.lock(id)()
+	deletedNew, err := re.newer.Delete(id)
+	if err != nil {
+		return false, err
+	}
+	deletedOld, err := re.older.Delete(id)
+	if err != nil {
+		return false, err
+	}
+	return deletedNew || deletedOld, nil
+}
+
+func (re *readThroughEngine) Drop() (bool, error) {
+	droppedNew, err := re.newer.Drop()
+	if err != nil {
+		return false, err
+	}
+	droppedOld, err := re.older.Drop()
+	if err != nil {
+		return false, err
+	}
+	return droppedNew || droppedOld, nil
+}
+
+// IDs lists the new backend's ids followed by those only in the old one.
+func (re *readThroughEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	seen := make(map[string]bool)
+	stopped := false
+	err := re.newer.IDs(func(entry rwapi.IDEntry) (bool, error) {
+		seen[entry.ID] = true
+		more, err := f(entry)
+		stopped = !more
+		return more, err
+	})
+	if err != nil || stopped {
+		return err
+	}
+	return re.older.IDs(func(entry rwapi.IDEntry) (bool, error) {
+		if seen[entry.ID] {
+			return true, nil
+		}
+		return f(entry)
+	})
+}
+
+func (re *readThroughEngine) Count() (int, error) {
+	count := 0
+	err := re.IDs(func(rwapi.IDEntry) (bool, error) {
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+// Documents streams the new backend's documents followed by those only in the
+// old one, without copying them across.
+func (re *readThroughEngine) Documents(f func(Document) (bool, error)) error {
+	seen := make(map[string]bool)
+	stopped := false
+	err := forEachDocument(re.newer, 8, func(doc Document) (bool, error) {
+		if id, ok := documentID(re.newer.IDPropertyName(), doc); ok {
+			seen[id] = true
+		}
+		more, err := f(doc)
+		stopped = !more
+		return more, err
+	})
+	if err != nil || stopped {
+		return err
+	}
+	return forEachDocument(re.older, 8, func(doc Document) (bool, error) {
+		if id, ok := documentID(re.older.IDPropertyName(), doc); ok && seen[id] {
+			return true, nil
+		}
+		return f(doc)
+	})
+}
+
+func (re *readThroughEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	return re.newer.DecodeJSON(dec)
+}
+
+func (re *readThroughEngine) IDPropertyName() string {
+	return re.newer.IDPropertyName()
+}
+
+func (re *readThroughEngine) Initialise() error {
+	if err := re.newer.Initialise(); err != nil {
+		return err
+	}
+	return re.older.Initialise()
+}
+
+func (re *readThroughEngine) Check() error {
+	if err := re.newer.Check(); err != nil {
+		return fmt.Errorf("new: %v", err)
+	}
+	if err := re.older.Check(); err != nil {
+		return fmt.Errorf("old: %v", err)
+	}
+	return nil
+}
+
+func (re *readThroughEngine) Close() {
+	re.newer.Close()
+	re.older.Close()
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/gorilla/mux"
+)
+
+// redirectProperty holds where a redirected id now points.
+const redirectProperty = "_redirect"
+
+// maxRedirects limits how many redirects are followed to find a canonical
+// document.
+const maxRedirects = 16
+
+var errRedirectLoop = errors.New("redirects loop")
+
+// redirectEngine stores redirects from old ids, such as those of concepts
+// merged into others, to the ids of their canonical documents. Redirects are
+// stored in place of documents, like tombstones, so backups, mirrors and copies
+// carry them with them, but reads, listings and counts treat them as absent.
+//
+// Hiding redirects from listings and counts, and finding a document's
+// aliases, means reading every document.
+type redirectEngine struct {
+	engine Engine
+	// serve is true to serve canonical documents at old ids, rather than
+	// redirecting to them.
+	serve bool
+}
+
+// redirect is stored in place of a document whose id redirects to another.
+type redirect struct {
+	To           string `json:"to"`
+	RedirectedAt string `json:"redirectedAt"`
+}
+
+// NewRedirectEngine returns an Engine that stores redirects in e. mode is
+// "redirect" to respond to reads of old ids with redirects, or "serve" to
+// serve the canonical documents.
+func NewRedirectEngine(e Engine, mode string) (Engine, error) {
+	if mode != "redirect" && mode != "serve" {
+		return nil, fmt.Errorf("unknown redirects mode %s, expected redirect or serve", mode)
+	}
+	return &redirectEngine{engine: e, serve: mode == "serve"}, nil
+}
+
+// redirectingEngines wraps each engine whose collection has redirects
+// configured.
+func redirectingEngines(engines map[string]Engine, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	wrapped := make(map[string]Engine)
+	for name, e := range engines {
+		if mode := collections[name].Redirects; mode != "" {
+			var err error
+			if e, err = NewRedirectEngine(e, mode); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		wrapped[name] = e
+	}
+	return wrapped, nil
+}
+
+// redirectEngineOf returns the redirect engine within a collection's
+// wrappers, if it has one.
+func redirectEngineOf(coll Engine) (*redirectEngine, bool) {
+	for _, e := range engineChain(coll) {
+		if re, ok := e.(*redirectEngine); ok {
+			return re, true
+		}
+	}
+	return nil, false
+}
+
+func redirectOf(doc Document) (*redirect, error) {
+	v, found := doc[redirectProperty]
+	if !found {
+		return nil, nil
+	}
+	// round trip through json to read the redirect however the engine
+	// decoded it
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var rd redirect
+	if err := json.Unmarshal(data, &rd); err != nil {
+		return nil, err
+	}
+	return &rd, nil
+}
+
+// readRedirect returns the redirect stored for an id, if there is one.
+func (re *redirectEngine) readRedirect(id string) (*redirect, error) {
+	doc, found, err := re.engine.Read(id)
+	if err != nil || !found {
+		return nil, err
+	}
+	return redirectOf(doc.(Document))
+}
+
+// resolve follows the redirects from an id, returning the id of the
+// canonical document, or "" if the id doesn't redirect.
+func (re *redirectEngine) resolve(id string) (string, error) {
+	target := ""
+	for hops := 0; hops < maxRedirects; hops++ {
+		rd, err := re.readRedirect(id)
+		if err != nil {
+			return "", err
+		}
+		if rd == nil {
+			return target, nil
+		}
+		target, id = rd.To, rd.To
+	}
+	return "", errRedirectLoop
+}
+
+// Redirect stores a redirect from one id to the canonical document of
+// another, replacing any document at from if replace is true. It returns
+// ErrNotFound if there's no document to redirect to.
+func (re *redirectEngine) Redirect(from, to string, replace bool) error {
+	if from == to {
+		return &redirectError{fmt.Sprintf("%s can't redirect to itself", from)}
+	}
+	canonical, err := re.resolve(to)
+	if err != nil {
+		return err
+	}
+	if canonical == "" {
+		canonical = to
+	}
+	if canonical == from {
+		return &redirectError{fmt.Sprintf("%s already redirects to %s", to, from)}
+	}
+	if _, found, err := re.Read(canonical); err != nil || !found {
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if !replace {
+		if _, found, err := re.Read(from); err != nil || found {
+			if err == nil {
+				err = &redirectError{fmt.Sprintf("there is a document with id %s", from)}
+			}
+			return err
+		}
+	}
+
+	data, err := json.Marshal(redirect{To: canonical, RedirectedAt: time.Now().UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	stored := Document{redirectProperty: value}
+	if err := setDocumentID(re.engine.IDPropertyName(), stored, from); err != nil {
+		return err
+	}
+	return re.engine.Write(stored)
+}
+
+// RemoveRedirect removes the redirect from an id, returning false if there
+// isn't one.
+func (re *redirectEngine) RemoveRedirect(from string) (bool, error) {
+	rd, err := re.readRedirect(from)
+	if err != nil || rd == nil {
+		return false, err
+	}
+	return re.engine.Delete(from)
+}
+
+// Aliases returns the ids that redirect, directly or through other redirects,
+// to an id.
+func (re *redirectEngine) Aliases(id string) ([]string, error) {
+	targets := make(map[string]string)
+	err := forEachDocument(re.engine, 8, func(doc Document) (bool, error) {
+		rd, err := redirectOf(doc)
+		if err != nil || rd == nil {
+			return true, err
+		}
+		if from, ok := documentID(re.engine.IDPropertyName(), doc); ok {
+			targets[from] = rd.To
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := []string{}
+	for from, to := range targets {
+		for hops := 0; hops < maxRedirects && to != ""; hops++ {
+			if to == id {
+				aliases = append(aliases, from)
+				break
+			}
+			to = targets[to]
+		}
+	}
+	sort.Strings(aliases)
+	return aliases, nil
+}
+
+func (re *redirectEngine) Read(id string) (interface{}, bool, error) {
+	doc, found, err := re.engine.Read(id)
+	if err != nil || !found {
+		return doc, found, err
+	}
+	if _, redirected := doc.(Document)[redirectProperty]; redirected {
+		return nil, false, nil
+	}
+	return doc, true, nil
+}
+
+// Update leaves redirected ids to be read, changed and written instead, which
+// replaces the redirect as a PUT would.
+func (re *redirectEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	rd, err := re.readRedirect(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if rd != nil {
+		return nil, false, errUpdateUnsupported
+	}
+	return update(re.engine, id, ops)
+}
+
+// ApplyBatch applies batches of puts, which replace redirects as Write does.
+// Batches with deletes, which have to leave redirects alone, can't be applied
+// atomically.
+func (re *redirectEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	for _, op := range ops {
+		if op.Delete {
+			return nil, errBatchUnsupported
+		}
+	}
+	return applyBatch(re.engine, ops)
+}
+
+// Delete doesn't delete redirects, which are removed with RemoveRedirect.
+func (re *redirectEngine) Delete(id string) (bool, error) {
+	rd, err := re.readRedirect(id)
+	if err != nil || rd != nil {
+		return false, err
+	}
+	return re.engine.Delete(id)
+}
+
+func (re *redirectEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(re.engine, 8, func(doc Document) (bool, error) {
+		if _, redirected := doc[redirectProperty]; redirected {
+			return true, nil
+		}
+		return f(doc)
+	})
+}
+
+// IDs reads every document to leave out redirects, so it costs as much as a
+// dump rather than the wrapped engine's own id listing.
+func (re *redirectEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return re.Documents(func(doc Document) (bool, error) {
+		id, _ := documentID(re.engine.IDPropertyName(), doc)
+		return f(rwapi.IDEntry{ID: id})
+	})
+}
+
+// Count reads every document to leave out redirects, rather than using the
+// wrapped engine's count.
+func (re *redirectEngine) Count() (int, error) {
+	count := 0
+	err := re.Documents(func(Document) (bool, error) {
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+// Write replaces any redirect from the document's id.
+func (re *redirectEngine) Write(resource interface{}) error {
+	return re.engine.Write(resource)
+}
+
+// Drop removes documents and redirects alike.
+func (re *redirectEngine) Drop() (bool, error) {
+	return re.engine.Drop()
+}
+
+func (re *redirectEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	return re.engine.DecodeJSON(dec)
+}
+
+func (re *redirectEngine) Unwrap() Engine {
+	return re.engine
+}
+
+func (re *redirectEngine) IDPropertyName() string {
+	return re.engine.IDPropertyName()
+}
+
+func (re *redirectEngine) Initialise() error {
+	return re.engine.Initialise()
+}
+
+func (re *redirectEngine) Check() error {
+	return re.engine.Check()
+}
+
+func (re *redirectEngine) Close() {
+	re.engine.Close()
+}
+
+// redirectError is a redirect that can't be made.
+type redirectError struct {
+	msg string
+}
+
+func (re *redirectError) Error() string {
+	return re.msg
+}
+
+// writeRedirected responds to a read of an old id, either redirecting to or
+// serving its canonical document.
+func writeRedirected(w http.ResponseWriter, r *http.Request, re *redirectEngine, collection string, target string) {
+	location := fmt.Sprintf("/%s/%s", collection, target)
+	if !re.serve {
+		http.Redirect(w, r, location, http.StatusMovedPermanently)
+		return
+	}
+	doc, found, err := re.Read(target)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("document with id %s was not found", target), http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Location", location)
+	writeDocument(w, r, doc)
+}
+
+// redirectRequest reads the collection and id of a redirect request,
+// responding with an error and returning false if the collection doesn't
+// have redirects.
+func (ah *apiHandlers) redirectRequest(w http.ResponseWriter, r *http.Request) (*redirectEngine, Engine, string, bool) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	re, ok := redirectEngineOf(coll)
+	if !ok {
+		http.Error(w, "collection doesn't have redirects configured", http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	id, err := normaliseID(coll, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, "", false
+	}
+	return re, coll, id, true
+}
+
+// redirectReadHandler responds with where an old id redirects to.
+func (ah *apiHandlers) redirectReadHandler(w http.ResponseWriter, r *http.Request) {
+	re, _, id, ok := ah.redirectRequest(w, r)
+	if !ok {
+		return
+	}
+	rd, err := re.readRedirect(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rd == nil {
+		http.Error(w, fmt.Sprintf("%s doesn't redirect", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rd)
+}
+
+// redirectWriteHandler redirects an old id to another document, given as
+// {"to": "..."}.
+func (ah *apiHandlers) redirectWriteHandler(w http.ResponseWriter, r *http.Request) {
+	re, coll, id, ok := ah.redirectRequest(w, r)
+	if !ok {
+		return
+	}
+	var rd redirect
+	if err := json.NewDecoder(r.Body).Decode(&rd); err != nil || rd.To == "" {
+		http.Error(w, `expected {"to": "<id>"}`, http.StatusBadRequest)
+		return
+	}
+	to, err := normaliseID(coll, rd.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = re.Redirect(id, to, r.URL.Query().Get("replace") == "true")
+	if _, conflict := err.(*redirectError); conflict || err == errRedirectLoop {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	switch err {
+	case nil:
+	case ErrNotFound:
+		http.Error(w, fmt.Sprintf("document with id %s was not found", to), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (ah *apiHandlers) redirectDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	re, _, id, ok := ah.redirectRequest(w, r)
+	if !ok {
+		return
+	}
+	removed, err := re.RemoveRedirect(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !removed {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// aliasesHandler lists the old ids that redirect to a document.
+func (ah *apiHandlers) aliasesHandler(w http.ResponseWriter, r *http.Request) {
+	re, _, id, ok := ah.redirectRequest(w, r)
+	if !ok {
+		return
+	}
+	aliases, err := re.Aliases(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(aliases)
+}
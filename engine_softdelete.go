@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Financial-Times/up-rw-app-api-go/rwapi"
+	"github.com/gorilla/mux"
+)
+
+// tombstoneProperty holds the details of a soft deleted document.
+const tombstoneProperty = "_tombstone"
+
+var errNotDeleted = errors.New("document is not deleted")
+
+// softDeleteEngine replaces deleted documents with tombstones recording when
+// and why they were deleted, along with the deleted document so that it can be
+// undeleted. Tombstones are stored like any other document, so backups,
+// mirrors and copies carry deletions with them, but reads, listings and counts
+// treat them as absent.
+//
+// Hiding tombstones from listings and counts means reading every document.
+type softDeleteEngine struct {
+	engine Engine
+}
+
+// tombstone is stored in place of a soft deleted document.
+type tombstone struct {
+	DeletedAt string   `json:"deletedAt"`
+	Reason    string   `json:"reason,omitempty"`
+	Document  Document `json:"document"`
+}
+
+// NewSoftDeleteEngine returns an Engine that soft deletes documents from e.
+func NewSoftDeleteEngine(e Engine) Engine {
+	return &softDeleteEngine{engine: e}
+}
+
+// softDeletingEngines wraps each engine whose collection has soft deletes
+// configured.
+func softDeletingEngines(engines map[string]Engine, collections map[string]CollectionSettings) map[string]Engine {
+	wrapped := make(map[string]Engine)
+	for name, e := range engines {
+		if collections[name].SoftDelete {
+			e = NewSoftDeleteEngine(e)
+		}
+		wrapped[name] = e
+	}
+	return wrapped
+}
+
+// softDeleteEngineOf returns the soft delete engine within a collection's
+// wrappers, if it has one.
+func softDeleteEngineOf(coll Engine) (*softDeleteEngine, bool) {
+	for _, e := range engineChain(coll) {
+		if se, ok := e.(*softDeleteEngine); ok {
+			return se, true
+		}
+	}
+	return nil, false
+}
+
+// readTombstone returns the tombstone for an id, if it has been soft deleted.
+func (se *softDeleteEngine) readTombstone(id string) (*tombstone, error) {
+	doc, found, err := se.engine.Read(id)
+	if err != nil || !found {
+		return nil, err
+	}
+	return tombstoneOf(doc.(Document))
+}
+
+func tombstoneOf(doc Document) (*tombstone, error) {
+	v, found := doc[tombstoneProperty]
+	if !found {
+		return nil, nil
+	}
+	// round trip through json to read the tombstone however the engine
+	// decoded it
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var ts tombstone
+	if err := json.Unmarshal(data, &ts); err != nil {
+		return nil, err
+	}
+	return &ts, nil
+}
+
+func (se *softDeleteEngine) Read(id string) (interface{}, bool, error) {
+	doc, found, err := se.engine.Read(id)
+	if err != nil || !found {
+		return doc, found, err
+	}
+	if _, deleted := doc.(Document)[tombstoneProperty]; deleted {
+		return nil, false, nil
+	}
+	return doc, true, nil
+}
+
+// Update leaves soft deleted documents to be read, changed and written
+// instead, which replaces the tombstone as a PUT would.
+func (se *softDeleteEngine) Update(id string, ops *Operations) (Document, bool, error) {
+	ts, err := se.readTombstone(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if ts != nil {
+		return nil, false, errUpdateUnsupported
+	}
+	return update(se.engine, id, ops)
+}
+
+// ApplyBatch applies batches of puts, which replace tombstones as Write does.
+// Batches with deletes, which read the documents they soft delete, can't be
+// applied atomically.
+func (se *softDeleteEngine) ApplyBatch(ops []BatchOperation) ([]bool, error) {
+	for _, op := range ops {
+		if op.Delete {
+			return nil, errBatchUnsupported
+		}
+	}
+	return applyBatch(se.engine, ops)
+}
+
+func (se *softDeleteEngine) Delete(id string) (bool, error) {
+	return se.SoftDelete(id, "")
+}
+
+// SoftDelete replaces a document with a tombstone. It returns false if there
+// is no document, or it is already deleted.
+func (se *softDeleteEngine) SoftDelete(id string, reason string) (bool, error) {
+	doc, found, err := se.Read(id)
+	if err != nil || !found {
+		return false, err
+	}
+	ts := tombstone{
+		DeletedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Reason:    reason,
+		Document:  doc.(Document),
+	}
+	data, err := json.Marshal(ts)
+	if err != nil {
+		return false, err
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return false, err
+	}
+	stored := Document{tombstoneProperty: value}
+	if err := setDocumentID(se.engine.IDPropertyName(), stored, id); err != nil {
+		return false, err
+	}
+	return true, se.engine.Write(stored)
+}
+
+// softDelete soft deletes a document from a collection with a reason. Like
+// the redirect engine's Delete, it leaves ids that redirect alone.
+func softDelete(coll Engine, se *softDeleteEngine, id string, reason string) (bool, error) {
+	if re, ok := redirectEngineOf(coll); ok {
+		if rd, err := re.readRedirect(id); err != nil || rd != nil {
+			return false, err
+		}
+	}
+	return se.SoftDelete(id, reason)
+}
+
+// Undelete restores a soft deleted document. It returns ErrNotFound if there's
+// no document or tombstone, and errNotDeleted if the document isn't deleted.
+func (se *softDeleteEngine) Undelete(id string) error {
+	doc, found, err := se.engine.Read(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	ts, err := tombstoneOf(doc.(Document))
+	if err != nil {
+		return err
+	}
+	if ts == nil {
+		return errNotDeleted
+	}
+	restored, _, err := decodeDocument(se.engine, ts.Document)
+	if err != nil {
+		return err
+	}
+	return se.engine.Write(restored)
+}
+
+func (se *softDeleteEngine) Documents(f func(Document) (bool, error)) error {
+	return forEachDocument(se.engine, 8, func(doc Document) (bool, error) {
+		if _, deleted := doc[tombstoneProperty]; deleted {
+			return true, nil
+		}
+		return f(doc)
+	})
+}
+
+// IDs reads every document to leave out tombstones, so it costs as much as
+// a dump rather than the wrapped engine's own id listing.
+func (se *softDeleteEngine) IDs(f func(rwapi.IDEntry) (bool, error)) error {
+	return se.Documents(func(doc Document) (bool, error) {
+		id, _ := documentID(se.engine.IDPropertyName(), doc)
+		return f(rwapi.IDEntry{ID: id})
+	})
+}
+
+// Count reads every document to leave out tombstones, rather than using the
+// wrapped engine's count. No tombstone count is kept, as it couldn't be
+// trusted across restarts, restores or instances sharing a store.
+func (se *softDeleteEngine) Count() (int, error) {
+	count := 0
+	err := se.Documents(func(Document) (bool, error) {
+		count++
+		return true, nil
+	})
+	return count, err
+}
+
+func (se *softDeleteEngine) Write(resource interface{}) error {
+	return se.engine.Write(resource)
+}
+
+// Drop removes documents and tombstones alike.
+func (se *softDeleteEngine) Drop() (bool, error) {
+	return se.engine.Drop()
+}
+
+func (se *softDeleteEngine) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	return se.engine.DecodeJSON(dec)
+}
+
+func (se *softDeleteEngine) Unwrap() Engine {
+	return se.engine
+}
+
+func (se *softDeleteEngine) IDPropertyName() string {
+	return se.engine.IDPropertyName()
+}
+
+func (se *softDeleteEngine) Initialise() error {
+	return se.engine.Initialise()
+}
+
+func (se *softDeleteEngine) Check() error {
+	return se.engine.Check()
+}
+
+func (se *softDeleteEngine) Close() {
+	se.engine.Close()
+}
+
+// undeleteHandler restores a soft deleted document.
+func (ah *apiHandlers) undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	se, ok := softDeleteEngineOf(coll)
+	if !ok {
+		http.Error(w, "collection doesn't have soft deletes configured", http.StatusBadRequest)
+		return
+	}
+	id, err := normaliseID(coll, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer ah.locks.lock(vars["collection"] + "/" + id)()
+	switch err := se.Undelete(id); err {
+	case nil:
+	case ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errNotDeleted:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeGone responds to a read of a soft deleted document with its tombstone,
+// without the deleted document.
+func writeGone(w http.ResponseWriter, id string, ts *tombstone) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusGone)
+	json.NewEncoder(w).Encode(map[string]string{
+		"id":        id,
+		"deletedAt": ts.DeletedAt,
+		"reason":    ts.Reason,
+	})
+}
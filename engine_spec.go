@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+)
+
+func elasticEngines(esURL string, indexName string, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 30}}
+
+	engs := make(map[string]Engine)
+	for _, c := range collections {
+		e := NewElasticEngine(esURL, indexName, c.name, c.idPropertyName, client)
+		if err := e.Initialise(); err != nil {
+			return nil, err
+		}
+		engs[c.name] = e
+	}
+	return engs, nil
+}
+
+// mongoEngines opens a mongodb engine for each collection. If binaryIDFormat
+// is set, ids are stored as binary uuids in that format.
+func mongoEngines(hostports string, dbname string, binaryIDFormat string, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	log.Printf("connecting to mongodb '%s'\n", hostports)
+	s, err := mgo.Dial(hostports)
+	if err != nil {
+		return nil, err
+	}
+	s.SetMode(mgo.Monotonic, true)
+
+	engs := make(map[string]Engine)
+	for _, c := range collections {
+		e, err := NewMongoEngine(dbname, c.name, c.idPropertyName, MongoOptions{
+			BinaryID:             binaryIDFormat != "",
+			BinaryIDFormat:       binaryIDFormat,
+			Compression:          c.Compression,
+			CompressionThreshold: c.CompressionThreshold,
+			ExpiryProperty:       c.expiryProperty(),
+		}, s)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.Initialise(); err != nil {
+			return nil, err
+		}
+		engs[c.name] = e
+	}
+	return engs, nil
+}
+
+// boltEngines opens a bolt engine for each collection. The compression and
+// expiry property in opts are replaced by each collection's own settings.
+func boltEngines(dbdir string, opts BoltOptions, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	engs := make(map[string]Engine)
+	for _, c := range collections {
+		opts.Compression = c.Compression
+		opts.ExpiryProperty = c.expiryProperty()
+		e, err := NewBoltEngine(dbdir, c.name, c.idPropertyName, opts)
+		if err != nil {
+			closeEngines(engs)
+			return nil, err
+		}
+		engs[c.name] = e
+	}
+	return engs, nil
+}
+
+func closeEngines(engines map[string]Engine) {
+	for _, e := range engines {
+		e.Close()
+	}
+}
+
+// openEngines opens the collections in the backend described by an engine
+// spec, one of
+//
+//	boltdb:/data?codec=json&key-file=/secrets/keys&unsafe=true
+//	mongo://host1:27017,host2:27017/dbname?binary-identity=true&binary-identity-format=legacy
+//	elastic://host:9200/index or elastic+https://host:9200/index
+func openEngines(spec string, collections map[string]CollectionSettings) (map[string]Engine, error) {
+	scheme, location, params, err := parseEngineSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	switch scheme {
+	case "boltdb":
+		unsafe, err := boolParam(params, "unsafe")
+		if err != nil {
+			return nil, err
+		}
+		opts := BoltOptions{Unsafe: unsafe, Codec: params.Get("codec")}
+		if keyFile := params.Get("key-file"); keyFile != "" {
+			if opts.Keys, err = readKeyFile(keyFile); err != nil {
+				return nil, err
+			}
+		}
+		return boltEngines(location, opts, collections)
+
+	case "mongo":
+		hosts, dbname := splitLocation(location)
+		if dbname == "" {
+			dbname = "store"
+		}
+		binaryID, err := boolParam(params, "binary-identity")
+		if err != nil {
+			return nil, err
+		}
+		binaryIDFormat := ""
+		if binaryID {
+			binaryIDFormat = params.Get("binary-identity-format")
+			if binaryIDFormat == "" {
+				binaryIDFormat = "standard"
+			}
+		}
+		return mongoEngines(hosts, dbname, binaryIDFormat, collections)
+
+	case "elastic", "elastic+http", "elastic+https":
+		host, indexName := splitLocation(location)
+		if indexName == "" {
+			indexName = "store"
+		}
+		protocol := "http"
+		if scheme == "elastic+https" {
+			protocol = "https"
+		}
+		return elasticEngines(fmt.Sprintf("%s://%s/", protocol, host), indexName, collections)
+
+	default:
+		return nil, fmt.Errorf("unknown engine type %s in %s", scheme, spec)
+	}
+}
+
+// parseEngineSpec splits an engine spec into its scheme, location and query
+// parameters. Specs aren't parsed as urls because mongodb host lists aren't
+// valid url hosts.
+func parseEngineSpec(spec string) (string, string, url.Values, error) {
+	i := strings.Index(spec, ":")
+	if i < 1 {
+		return "", "", nil, fmt.Errorf("can't parse engine %s, expected e.g. boltdb:/data or mongo://host:27017/dbname", spec)
+	}
+	scheme, location := spec[:i], strings.TrimPrefix(spec[i+1:], "//")
+
+	params := url.Values{}
+	if j := strings.Index(location, "?"); j >= 0 {
+		var err error
+		if params, err = url.ParseQuery(location[j+1:]); err != nil {
+			return "", "", nil, err
+		}
+		location = location[:j]
+	}
+	if location == "" {
+		return "", "", nil, fmt.Errorf("no location in engine %s", spec)
+	}
+	return scheme, location, params, nil
+}
+
+// splitLocation splits "host:port/name" into host and name.
+func splitLocation(location string) (string, string) {
+	if i := strings.Index(location, "/"); i >= 0 {
+		return location[:i], strings.Trim(location[i+1:], "/")
+	}
+	return location, ""
+}
+
+func boolParam(params url.Values, name string) (bool, error) {
+	v := params.Get(name)
+	if v == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %s for %s", v, name)
+	}
+	return b, nil
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	mediaTypeJSON    = "application/json"
+	mediaTypeNDJSON  = "application/x-ndjson"
+	mediaTypeCSV     = "text/csv"
+	mediaTypeMsgpack = "application/msgpack"
+	mediaTypeCBOR    = "application/cbor"
+)
+
+var errNotAcceptable = errors.New("none of the accepted media types are supported")
+
+// unsupportedMediaTypeError is returned for request bodies in a format or
+// encoding that isn't supported.
+type unsupportedMediaTypeError struct {
+	msg string
+}
+
+func (ue *unsupportedMediaTypeError) Error() string {
+	return ue.msg
+}
+
+// binaryHandles are the codecs for the binary media types. Maps decode as
+// map[string]interface{} so documents look the same as if decoded from json.
+var binaryHandles = map[string]codec.Handle{
+	mediaTypeMsgpack: func() codec.Handle {
+		h := &codec.MsgpackHandle{}
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		h.RawToString = true
+		h.WriteExt = true
+		return h
+	}(),
+	mediaTypeCBOR: func() codec.Handle {
+		h := &codec.CborHandle{}
+		h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+		return h
+	}(),
+}
+
+// writeDocument writes a single document in the format picked from the
+// request's Accept header, json by default.
+func writeDocument(w http.ResponseWriter, r *http.Request, doc interface{}) {
+	writeDocumentStatus(w, r, doc, http.StatusOK)
+}
+
+// writeDocumentStatus is writeDocument with a response status other than 200.
+func writeDocumentStatus(w http.ResponseWriter, r *http.Request, doc interface{}, status int) {
+	mediaType := negotiate(r.Header.Get("Accept"), []string{mediaTypeJSON, mediaTypeMsgpack, mediaTypeCBOR})
+	switch mediaType {
+	case "":
+		http.Error(w, errNotAcceptable.Error(), http.StatusNotAcceptable)
+	case mediaTypeMsgpack, mediaTypeCBOR:
+		w.Header().Add("Content-Type", mediaType)
+		w.WriteHeader(status)
+		codec.NewEncoder(w, binaryHandles[mediaType]).Encode(doc)
+	default:
+		w.Header().Add("Content-Type", mediaTypeJSON)
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.Encode(doc)
+	}
+}
+
+// decodeRequestDocument decodes the single document in a request body, in the
+// format given by its Content-Type header.
+func decodeRequestDocument(coll Engine, r *http.Request) (interface{}, string, error) {
+	body, mediaType, err := requestBody(r)
+	if err != nil {
+		return nil, "", err
+	}
+	switch mediaType {
+	case mediaTypeJSON, "text/plain":
+		return coll.DecodeJSON(json.NewDecoder(body))
+	case mediaTypeMsgpack, mediaTypeCBOR:
+		return newBinaryDecoder(body, mediaType).Decode(coll)
+	default:
+		return nil, "", &unsupportedMediaTypeError{fmt.Sprintf("unsupported content type %s", mediaType)}
+	}
+}
+
+// docEncoder writes a sequence of documents in some format. Close must be
+// called once all documents are written.
+type docEncoder interface {
+	Encode(doc Document) error
+	Close() error
+}
+
+// docDecoder reads a sequence of documents, returning io.EOF after the last
+// one. Each document is decoded by the collection's engine, so it is returned
+// in the same form as Engine.DecodeJSON would return it.
+type docDecoder interface {
+	Decode(coll Engine) (interface{}, string, error)
+}
+
+// writeRequestError responds to a request body that couldn't be decoded.
+func writeRequestError(w http.ResponseWriter, err error) {
+	if _, ok := err.(*unsupportedMediaTypeError); ok {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// newResponseEncoder picks the response format for a stream of documents from
+// the request's Accept and Accept-Encoding headers. def is used if the client
+// has no preference, or accepts json without asking for an array with
+// ?format=array, which keeps the original formats of each endpoint for
+// existing clients.
+func newResponseEncoder(w http.ResponseWriter, r *http.Request, def func(io.Writer) docEncoder) (docEncoder, error) {
+	mediaType := negotiate(r.Header.Get("Accept"), []string{mediaTypeNDJSON, mediaTypeJSON, mediaTypeCSV, mediaTypeMsgpack, mediaTypeCBOR})
+	if mediaType == "" {
+		return nil, errNotAcceptable
+	}
+
+	var columns []csvColumn
+	if mediaType == mediaTypeCSV {
+		var err error
+		if columns, err = parseCSVColumns(r.URL.Query().Get("columns")); err != nil {
+			return nil, err
+		}
+		if len(columns) == 0 {
+			return nil, errors.New("csv responses need a columns parameter, e.g. ?columns=uuid,name:properName")
+		}
+	}
+
+	var out io.Writer = w
+	var closers []io.Closer
+	if acceptsGzip(r) {
+		gz := gzip.NewWriter(w)
+		out = gz
+		closers = append(closers, gz)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+
+	var enc docEncoder
+	switch mediaType {
+	case "*/*", mediaTypeJSON:
+		if r.URL.Query().Get("format") == "array" {
+			w.Header().Set("Content-Type", mediaTypeJSON)
+			enc = &arrayEncoder{w: out}
+		} else {
+			enc = def(out)
+		}
+	case mediaTypeNDJSON:
+		w.Header().Set("Content-Type", mediaTypeNDJSON)
+		enc = &streamEncoder{enc: json.NewEncoder(out), w: out}
+	case mediaTypeCSV:
+		w.Header().Set("Content-Type", mediaTypeCSV)
+		enc = newCSVEncoder(out, columns)
+	case mediaTypeMsgpack, mediaTypeCBOR:
+		w.Header().Set("Content-Type", mediaType)
+		enc = &binaryEncoder{enc: codec.NewEncoder(out, binaryHandles[mediaType])}
+	}
+	return &closingEncoder{enc, closers}, nil
+}
+
+// newRequestDecoder picks the format of a stream of documents in a request
+// body from its Content-Type and Content-Encoding headers.
+func newRequestDecoder(r *http.Request) (docDecoder, error) {
+	body, mediaType, err := requestBody(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case mediaTypeJSON, mediaTypeNDJSON, "text/plain":
+		return newJSONDecoder(body), nil
+	case mediaTypeCSV:
+		columns, err := parseCSVColumns(r.URL.Query().Get("columns"))
+		if err != nil {
+			return nil, err
+		}
+		return newCSVDecoder(body, columns)
+	case mediaTypeMsgpack, mediaTypeCBOR:
+		return newBinaryDecoder(body, mediaType), nil
+	default:
+		return nil, &unsupportedMediaTypeError{fmt.Sprintf("unsupported content type %s", mediaType)}
+	}
+}
+
+// requestBody returns the request body, uncompressed according to its
+// Content-Encoding, and its media type, which defaults to json.
+func requestBody(r *http.Request) (io.Reader, string, error) {
+	body := io.Reader(r.Body)
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, "", err
+		}
+		body = gz
+	default:
+		return nil, "", &unsupportedMediaTypeError{fmt.Sprintf("unsupported content encoding %s", r.Header.Get("Content-Encoding"))}
+	}
+
+	mediaType := mediaTypeJSON
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(ct); err != nil {
+			return nil, "", err
+		}
+	}
+	return body, mediaType, nil
+}
+
+// negotiate returns the offer that best matches an Accept header, "*/*" if
+// the client would accept anything, or "" if none of the offers match.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return "*/*"
+	}
+
+	type acceptRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qs, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, acceptRange{mediaType, q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+
+	for _, ar := range ranges {
+		if ar.mediaType == "*/*" {
+			return "*/*"
+		}
+		for _, offer := range offers {
+			if ar.mediaType == offer || strings.HasSuffix(ar.mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(ar.mediaType, "*")) {
+				return offer
+			}
+		}
+	}
+	return ""
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type closingEncoder struct {
+	docEncoder
+	closers []io.Closer
+}
+
+func (ce *closingEncoder) Close() error {
+	err := ce.docEncoder.Close()
+	for _, c := range ce.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// streamEncoder writes concatenated JSON documents, followed by sep. With an
+// empty separator this is newline delimited json.
+type streamEncoder struct {
+	enc *json.Encoder
+	w   io.Writer
+	sep string
+}
+
+func (se *streamEncoder) Encode(doc Document) error {
+	if err := se.enc.Encode(doc); err != nil {
+		return err
+	}
+	if se.sep != "" {
+		_, err := io.WriteString(se.w, se.sep)
+		return err
+	}
+	return nil
+}
+
+func (se *streamEncoder) Close() error {
+	return nil
+}
+
+type arrayEncoder struct {
+	w     io.Writer
+	count int
+}
+
+func (ae *arrayEncoder) Encode(doc Document) error {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	prefix := ",\n"
+	if ae.count == 0 {
+		prefix = "[\n"
+	}
+	ae.count++
+	if _, err := io.WriteString(ae.w, prefix); err != nil {
+		return err
+	}
+	_, err = ae.w.Write(b)
+	return err
+}
+
+func (ae *arrayEncoder) Close() error {
+	if ae.count == 0 {
+		_, err := io.WriteString(ae.w, "[]\n")
+		return err
+	}
+	_, err := io.WriteString(ae.w, "\n]\n")
+	return err
+}
+
+// csvColumn maps a csv column to a path within a document.
+type csvColumn struct {
+	header string
+	path   string
+}
+
+// parseCSVColumns parses a column mapping such as "uuid,name:properName,
+// tme:identifiers.0.identifierValue". A column without a path maps to the
+// property of the same name.
+func parseCSVColumns(mapping string) ([]csvColumn, error) {
+	var columns []csvColumn
+	if mapping == "" {
+		return columns, nil
+	}
+	for _, m := range strings.Split(mapping, ",") {
+		kv := strings.SplitN(m, ":", 2)
+		col := csvColumn{header: kv[0], path: kv[0]}
+		if len(kv) == 2 {
+			col.path = kv[1]
+		}
+		if col.header == "" || col.path == "" {
+			return nil, fmt.Errorf("can't parse csv column mapping %s", m)
+		}
+		columns = append(columns, col)
+	}
+	return columns, nil
+}
+
+type csvEncoder struct {
+	w       *csv.Writer
+	columns []csvColumn
+	started bool
+}
+
+func newCSVEncoder(w io.Writer, columns []csvColumn) *csvEncoder {
+	return &csvEncoder{w: csv.NewWriter(w), columns: columns}
+}
+
+func (ce *csvEncoder) Encode(doc Document) error {
+	if !ce.started {
+		ce.started = true
+		headers := make([]string, len(ce.columns))
+		for i, col := range ce.columns {
+			headers[i] = col.header
+		}
+		if err := ce.w.Write(headers); err != nil {
+			return err
+		}
+	}
+
+	record := make([]string, len(ce.columns))
+	for i, col := range ce.columns {
+		v, found := lookupPath(doc, col.path)
+		if !found || v == nil {
+			continue
+		}
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			record[i] = string(b)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return ce.w.Write(record)
+}
+
+func (ce *csvEncoder) Close() error {
+	ce.w.Flush()
+	return ce.w.Error()
+}
+
+// jsonDecoder reads either a stream of concatenated (or newline delimited)
+// documents, or a single array of documents.
+type jsonDecoder struct {
+	dec     *json.Decoder
+	started bool
+	isArray bool
+}
+
+func newJSONDecoder(r io.Reader) *jsonDecoder {
+	br := bufio.NewReader(r)
+	d := &jsonDecoder{}
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			break
+		}
+		if b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		d.isArray = b[0] == '['
+		break
+	}
+	d.dec = json.NewDecoder(br)
+	return d
+}
+
+func (jd *jsonDecoder) Decode(coll Engine) (interface{}, string, error) {
+	if jd.isArray {
+		if !jd.started {
+			jd.started = true
+			if _, err := jd.dec.Token(); err != nil {
+				return nil, "", err
+			}
+		}
+		if !jd.dec.More() {
+			if _, err := jd.dec.Token(); err != nil {
+				return nil, "", err
+			}
+			return nil, "", io.EOF
+		}
+	}
+	return coll.DecodeJSON(jd.dec)
+}
+
+type csvDecoder struct {
+	r     *csv.Reader
+	paths []string
+}
+
+// newCSVDecoder reads documents from csv with a header row. Headers are mapped
+// to document paths by columns, or used as top level property names if they
+// aren't in the mapping. All values are strings, and empty values are left
+// out of the document.
+func newCSVDecoder(r io.Reader, columns []csvColumn) (*csvDecoder, error) {
+	cr := csv.NewReader(r)
+	headers, err := cr.Read()
+	if err == io.EOF {
+		return &csvDecoder{r: cr}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mapping := make(map[string]string)
+	for _, col := range columns {
+		mapping[col.header] = col.path
+	}
+	paths := make([]string, len(headers))
+	for i, h := range headers {
+		if p, ok := mapping[h]; ok {
+			paths[i] = p
+		} else {
+			paths[i] = h
+		}
+	}
+	return &csvDecoder{r: cr, paths: paths}, nil
+}
+
+func (cd *csvDecoder) Decode(coll Engine) (interface{}, string, error) {
+	record, err := cd.r.Read()
+	if err != nil {
+		return nil, "", err
+	}
+	doc := make(map[string]interface{})
+	for i, v := range record {
+		if v != "" {
+			setPath(doc, cd.paths[i], v)
+		}
+	}
+	return decodeDocument(coll, doc)
+}
+
+// binaryEncoder writes a stream of concatenated msgpack or cbor documents.
+type binaryEncoder struct {
+	enc *codec.Encoder
+}
+
+func (be *binaryEncoder) Encode(doc Document) error {
+	return be.enc.Encode(doc)
+}
+
+func (be *binaryEncoder) Close() error {
+	return nil
+}
+
+// binaryDecoder reads a stream of concatenated msgpack or cbor documents.
+type binaryDecoder struct {
+	dec *codec.Decoder
+}
+
+func newBinaryDecoder(r io.Reader, mediaType string) *binaryDecoder {
+	return &binaryDecoder{codec.NewDecoder(bufio.NewReader(r), binaryHandles[mediaType])}
+}
+
+func (bd *binaryDecoder) Decode(coll Engine) (interface{}, string, error) {
+	var doc map[string]interface{}
+	if err := bd.dec.Decode(&doc); err != nil {
+		return nil, "", err
+	}
+	return decodeDocument(coll, doc)
+}
+
+// decodeDocument passes an already decoded document through the engine's
+// DecodeJSON, so that it is validated and identified as if it had been
+// submitted as json.
+func decodeDocument(coll Engine, doc map[string]interface{}) (interface{}, string, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	return coll.DecodeJSON(json.NewDecoder(bytes.NewReader(b)))
+}
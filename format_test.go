@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func TestNegotiate(t *testing.T) {
+	offers := []string{mediaTypeNDJSON, mediaTypeJSON, mediaTypeCSV, mediaTypeMsgpack, mediaTypeCBOR}
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "*/*"},
+		{" ", "*/*"},
+		{"*/*", "*/*"},
+		{"application/json", mediaTypeJSON},
+		{"application/json; charset=utf-8", mediaTypeJSON},
+		{"text/html, application/x-ndjson", mediaTypeNDJSON},
+		{"application/json;q=0.5, text/csv", mediaTypeCSV},
+		{"text/csv;q=0.2, application/cbor;q=0.8", mediaTypeCBOR},
+		{"*/*;q=0.1, application/msgpack", mediaTypeMsgpack},
+		{"application/*", mediaTypeNDJSON},
+		{"text/*", mediaTypeCSV},
+		{"text/html", ""},
+		{"text/csv;q=0", ""},
+		{"text/csv;q=x", ""},
+		{"not a media type", ""},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, negotiate(test.accept, offers), "Accept: %s", test.accept)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"br", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		assert.Equal(t, test.want, acceptsGzip(r), "Accept-Encoding: %s", test.acceptEncoding)
+	}
+}
+
+func TestRequestBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		encoding    string
+		want        string
+		unsupported bool
+		invalid     bool
+	}{
+		{contentType: "", want: mediaTypeJSON},
+		{contentType: "application/json; charset=utf-8", want: mediaTypeJSON},
+		{contentType: "text/csv", want: mediaTypeCSV},
+		{contentType: "text/csv", encoding: "identity", want: mediaTypeCSV},
+		{contentType: "text/csv", encoding: "gzip", want: mediaTypeCSV},
+		{contentType: "application/json", encoding: "br", unsupported: true},
+		{contentType: "application/json;;", invalid: true},
+	}
+	for _, test := range tests {
+		body := []byte(`{"id":"1"}`)
+		if test.encoding == "gzip" {
+			body = gzipped(t, body)
+		}
+		r := httptest.NewRequest("PUT", "/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", test.contentType)
+		r.Header.Set("Content-Encoding", test.encoding)
+
+		read, mediaType, err := requestBody(r)
+		_, unsupported := err.(*unsupportedMediaTypeError)
+		assert.Equal(t, test.unsupported, unsupported, "%+v", test)
+		if test.unsupported || test.invalid {
+			assert.Error(t, err, "%+v", test)
+			continue
+		}
+		assert.NoError(t, err, "%+v", test)
+		assert.Equal(t, test.want, mediaType, "%+v", test)
+		data, err := ioutil.ReadAll(read)
+		assert.NoError(t, err)
+		assert.Equal(t, `{"id":"1"}`, string(data), "%+v", test)
+	}
+}
+
+func TestResponseFormats(t *testing.T) {
+	testWithAPI(t, map[string]CollectionSettings{"c": collectionSettings("c", "id")}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+		assert.NoError(api.engines["c"].Write(Document{"id": "1", "n": 1.0}))
+		assert.NoError(api.engines["c"].Write(Document{"id": "2", "n": 2.0}))
+
+		stream := "{\"id\":\"1\",\"n\":1}\n\n{\"id\":\"2\",\"n\":2}\n\n"
+		array := "[\n{\"id\":\"1\",\"n\":1},\n{\"id\":\"2\",\"n\":2}\n]\n"
+		tests := []struct {
+			url         string
+			accept      string
+			status      int
+			contentType string
+			body        string
+		}{
+			// existing clients get the original format, whether or not they
+			// say they accept json
+			{"/c/", "", http.StatusOK, "", stream},
+			{"/c/", "*/*", http.StatusOK, "", stream},
+			{"/c/", "application/json", http.StatusOK, "", stream},
+			{"/c/?format=array", "application/json", http.StatusOK, mediaTypeJSON, array},
+			{"/c/?format=array", "", http.StatusOK, mediaTypeJSON, array},
+			{"/c/", "application/x-ndjson", http.StatusOK, mediaTypeNDJSON, "{\"id\":\"1\",\"n\":1}\n{\"id\":\"2\",\"n\":2}\n"},
+			{"/c/?columns=n,id", "text/csv", http.StatusOK, mediaTypeCSV, "n,id\n1,1\n2,2\n"},
+			{"/c/", "text/csv", http.StatusBadRequest, "", ""},
+			{"/c/", "text/html", http.StatusNotAcceptable, "", ""},
+			{"/c/__ids", "", http.StatusOK, "", "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"},
+			{"/c/__ids", "application/json", http.StatusOK, "", "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"},
+			{"/c/__ids?format=array", "application/json", http.StatusOK, mediaTypeJSON, "[\n{\"id\":\"1\"},\n{\"id\":\"2\"}\n]\n"},
+		}
+		for _, test := range tests {
+			w := api.do("GET", test.url, "", "Accept", test.accept)
+			assert.Equal(test.status, w.Code, "%+v", test)
+			if test.status != http.StatusOK {
+				continue
+			}
+			if test.contentType != "" {
+				assert.Equal(test.contentType, w.Header().Get("Content-Type"), "%+v", test)
+			}
+			assert.Equal(test.body, w.Body.String(), "%+v", test)
+		}
+
+		w := api.do("GET", "/c/", "", "Accept-Encoding", "gzip")
+		assert.Equal("gzip", w.Header().Get("Content-Encoding"))
+		gz, err := gzip.NewReader(w.Body)
+		assert.NoError(err)
+		data, err := ioutil.ReadAll(gz)
+		assert.NoError(err)
+		assert.Equal(stream, string(data))
+	})
+}
+
+func TestRequestFormats(t *testing.T) {
+	testWithAPI(t, map[string]CollectionSettings{"c": collectionSettings("c", "id")}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		tests := []struct {
+			contentType string
+			encoding    string
+			body        string
+			status      int
+			ids         []string
+		}{
+			{"application/json", "", `{"id":"1"}{"id":"2"}`, http.StatusOK, []string{"1", "2"}},
+			{"application/json", "", `[{"id":"3"}, {"id":"4"}]`, http.StatusOK, []string{"3", "4"}},
+			{"application/x-ndjson", "gzip", "{\"id\":\"5\"}\n{\"id\":\"6\"}\n", http.StatusOK, []string{"5", "6"}},
+			{"text/csv", "", "id,name\n7,seven\n", http.StatusOK, []string{"7"}},
+			{"application/xml", "", "<id>8</id>", http.StatusUnsupportedMediaType, nil},
+			{"application/json", "br", `{"id":"9"}`, http.StatusUnsupportedMediaType, nil},
+			{"application/json", "", `{"id":"10"`, http.StatusInternalServerError, nil},
+		}
+		for _, test := range tests {
+			body := test.body
+			if test.encoding == "gzip" {
+				body = string(gzipped(t, []byte(body)))
+			}
+			w := api.do("PUT", "/c/", body, "Content-Type", test.contentType, "Content-Encoding", test.encoding)
+			assert.Equal(test.status, w.Code, "%+v", test)
+			for _, id := range test.ids {
+				_, found, err := api.engines["c"].Read(id)
+				assert.NoError(err)
+				assert.True(found, "%+v", test)
+			}
+		}
+
+		w := api.do("PUT", "/c/8", "<id>8</id>", "Content-Type", "application/xml")
+		assert.Equal(http.StatusUnsupportedMediaType, w.Code)
+		w = api.do("PUT", "/c/8", `{"id":"9"}`, "Content-Type", "application/json")
+		assert.Equal(http.StatusBadRequest, w.Code)
+		count, err := api.engines["c"].Count()
+		assert.NoError(err)
+		assert.Equal(7, count)
+	})
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	testWithAPI(t, map[string]CollectionSettings{"c": collectionSettings("c", "id")}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		for id, mediaType := range map[string]string{"msgpack": mediaTypeMsgpack, "cbor": mediaTypeCBOR} {
+			doc := map[string]interface{}{"id": id, "name": "Jane", "age": 42.0, "tags": []interface{}{"a", "b"}}
+			var buf bytes.Buffer
+			assert.NoError(codec.NewEncoder(&buf, binaryHandles[mediaType]).Encode(doc))
+
+			w := api.do("PUT", "/c/"+id, buf.String(), "Content-Type", mediaType)
+			assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+			w = api.do("GET", "/c/"+id, "", "Accept", mediaType)
+			assert.Equal(http.StatusOK, w.Code)
+			assert.Equal(mediaType, w.Header().Get("Content-Type"))
+			var read map[string]interface{}
+			assert.NoError(codec.NewDecoder(w.Body, binaryHandles[mediaType]).Decode(&read))
+			assert.Equal("Jane", read["name"], mediaType)
+			assert.Equal([]interface{}{"a", "b"}, read["tags"], mediaType)
+
+			// json sees the same document
+			w = api.do("GET", "/c/"+id, "", "Accept", mediaTypeJSON)
+			var fromJSON map[string]interface{}
+			assert.NoError(json.Unmarshal(w.Body.Bytes(), &fromJSON))
+			assert.Equal(doc, fromJSON)
+		}
+	})
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCSVEncoder(t *testing.T) {
+	assert := assert.New(t)
+
+	columns, err := parseCSVColumns("name:prefLabel,uuid,tme:identifiers.0.value,aliases,meta,active,missing")
+	assert.NoError(err)
+	var buf bytes.Buffer
+	enc := newCSVEncoder(&buf, columns)
+	assert.NoError(enc.Encode(Document{
+		"uuid":        "1",
+		"prefLabel":   "Jane, Doe",
+		"identifiers": []interface{}{map[string]interface{}{"value": "t1"}},
+		"aliases":     []interface{}{"J", "JD"},
+		"meta":        map[string]interface{}{"b": 2.0, "a": 1.0},
+		"active":      true,
+	}))
+	assert.NoError(enc.Encode(Document{"uuid": "2", "count": 3.0}))
+	assert.NoError(enc.Close())
+
+	// columns are in the order of the mapping, and nested values are json
+	assert.Equal("name,uuid,tme,aliases,meta,active,missing\n"+
+		"\"Jane, Doe\",1,t1,\"[\"\"J\"\",\"\"JD\"\"]\",\"{\"\"a\"\":1,\"\"b\"\":2}\",true,\n"+
+		",2,,,,,\n", buf.String())
+
+	for _, mapping := range []string{"uuid,", ":path", "name:"} {
+		_, err := parseCSVColumns(mapping)
+		assert.Error(err, mapping)
+	}
+}
+
+func TestCSVDecoder(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		columns, err := parseCSVColumns("name:prefLabel,tme:identifiers.tme")
+		assert.NoError(err)
+		// headers needn't be in the order of the mapping, and unmapped ones
+		// are top level properties
+		body := "tme,id,name\nt1,1,Jane\n,2,\n"
+		dec, err := newCSVDecoder(strings.NewReader(body), columns)
+		assert.NoError(err)
+
+		doc, id, err := dec.Decode(e)
+		assert.NoError(err)
+		assert.Equal("1", id)
+		assert.Equal(Document{
+			"id":          "1",
+			"prefLabel":   "Jane",
+			"identifiers": map[string]interface{}{"tme": "t1"},
+		}, doc)
+
+		doc, id, err = dec.Decode(e)
+		assert.NoError(err)
+		assert.Equal("2", id)
+		assert.Equal(Document{"id": "2"}, doc)
+
+		_, _, err = dec.Decode(e)
+		assert.Equal(io.EOF, err)
+
+		dec, err = newCSVDecoder(strings.NewReader(""), nil)
+		assert.NoError(err)
+		_, _, err = dec.Decode(e)
+		assert.Equal(io.EOF, err)
+	})
+}
+
+func TestBinaryDecoder(t *testing.T) {
+	testWithBolt(t, func(t *testing.T, e Engine) {
+		assert := assert.New(t)
+
+		for _, mediaType := range []string{mediaTypeMsgpack, mediaTypeCBOR} {
+			docs := []map[string]interface{}{
+				{
+					"id":     "1",
+					"nested": map[string]interface{}{"deeper": map[string]interface{}{"n": 1.5}},
+					"list":   []interface{}{map[string]interface{}{"k": "v"}, "s"},
+				},
+				{"id": "2"},
+			}
+			var buf bytes.Buffer
+			enc := &binaryEncoder{enc: codec.NewEncoder(&buf, binaryHandles[mediaType])}
+			for _, doc := range docs {
+				assert.NoError(enc.Encode(doc))
+			}
+			assert.NoError(enc.Close())
+
+			// maps decode with string keys, at any depth, so documents
+			// look the same as if decoded from json
+			var raw map[string]interface{}
+			assert.NoError(codec.NewDecoderBytes(buf.Bytes(), binaryHandles[mediaType]).Decode(&raw))
+			nested, ok := raw["nested"].(map[string]interface{})
+			assert.True(ok, "%s nested %T", mediaType, raw["nested"])
+			_, ok = nested["deeper"].(map[string]interface{})
+			assert.True(ok, "%s deeper %T", mediaType, nested["deeper"])
+			_, ok = raw["list"].([]interface{})[0].(map[string]interface{})
+			assert.True(ok, "%s list element %T", mediaType, raw["list"].([]interface{})[0])
+			_, ok = raw["id"].(string)
+			assert.True(ok, "%s id %T", mediaType, raw["id"])
+
+			dec := newBinaryDecoder(&buf, mediaType)
+			for _, want := range docs {
+				doc, id, err := dec.Decode(e)
+				assert.NoError(err, mediaType)
+				assert.Equal(want["id"], id)
+				assert.Equal(Document(want), doc, mediaType)
+			}
+			_, _, err := dec.Decode(e)
+			assert.Equal(io.EOF, err, mediaType)
+		}
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/oklog/ulid"
+	"github.com/pborman/uuid"
+)
+
+// IDGenerator configures how ids are generated for documents POSTed without
+// one.
+type IDGenerator struct {
+	// Type is uuidv4 (the default), uuidv5 or ulid.
+	Type string `json:"type"`
+	// Namespace and Field configure uuidv5 ids, which are derived from the
+	// namespace uuid and the string at the dotted path Field in the
+	// document, so the same document always gets the same id.
+	Namespace string `json:"namespace"`
+	Field     string `json:"field"`
+
+	namespace uuid.UUID
+}
+
+// idGenerators returns each collection's id generator, checking their
+// configuration.
+func idGenerators(collections map[string]CollectionSettings) (map[string]*IDGenerator, error) {
+	generators := make(map[string]*IDGenerator)
+	for name, c := range collections {
+		g := &IDGenerator{Type: "uuidv4"}
+		if c.IDGenerator != nil {
+			g = c.IDGenerator
+		}
+		if err := g.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		generators[name] = g
+	}
+	return generators, nil
+}
+
+func (g *IDGenerator) compile() error {
+	switch g.Type {
+	case "", "uuidv4", "ulid":
+		return nil
+	case "uuidv5":
+		if g.namespace = uuid.Parse(g.Namespace); g.namespace == nil {
+			return fmt.Errorf("uuidv5 id namespace %q is not a uuid", g.Namespace)
+		}
+		if g.Field == "" {
+			return fmt.Errorf("uuidv5 ids need a field to derive them from")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown id generator %s", g.Type)
+	}
+}
+
+// generate returns a new id for a document.
+func (g *IDGenerator) generate(doc Document) (string, error) {
+	switch g.Type {
+	case "ulid":
+		id, err := ulid.New(ulid.Now(), rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	case "uuidv5":
+		v, found := lookupPath(doc, g.Field)
+		name, ok := v.(string)
+		if !found || !ok || name == "" {
+			return "", fmt.Errorf("document has no %s to derive its id from", g.Field)
+		}
+		return uuid.NewSHA1(g.namespace, []byte(name)).String(), nil
+	default:
+		return uuid.NewRandom().String(), nil
+	}
+}
+
+// idlessDecoder decodes documents without requiring an id, so that one can be
+// generated.
+type idlessDecoder struct {
+	Engine
+}
+
+func (idlessDecoder) DecodeJSON(dec *json.Decoder) (interface{}, string, error) {
+	var doc Document
+	if err := dec.Decode(&doc); err != nil {
+		return nil, "", err
+	}
+	return doc, "", nil
+}
+
+// createHandler stores a document under a newly generated id, responding with
+// its location and, under "id" whatever the collection's id property, the id.
+func (ah *apiHandlers) createHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	raw, _, err := decodeRequestDocument(idlessDecoder{coll}, r)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	doc := raw.(Document)
+	if hasDocumentID(coll.IDPropertyName(), doc) {
+		http.Error(w, fmt.Sprintf("document already has a %s, PUT it instead", coll.IDPropertyName()), http.StatusBadRequest)
+		return
+	}
+	id, derived := deriveID(coll, doc)
+	if !derived {
+		if id, err = ah.generators[vars["collection"]].generate(doc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := setDocumentID(coll.IDPropertyName(), doc, id); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// decode again with the engine, as if the document had been PUT
+	decoded, id, err := decodeDocument(coll, doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ah.schemas.validate(vars["collection"], id, decoded); err != nil {
+		if ve, ok := err.(*validationError); ok {
+			writeValidationError(w, ve)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := coll.Write(decoded); err != nil {
+		http.Error(w, fmt.Sprintf("write failed:\n%v\n", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Add("Location", fmt.Sprintf("/%s/%s", vars["collection"], id))
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(Document{"id": id})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDGenerators(t *testing.T) {
+	assert := assert.New(t)
+
+	g := &IDGenerator{}
+	assert.NoError(g.compile())
+	id, err := g.generate(Document{})
+	assert.NoError(err)
+	u := uuid.Parse(id)
+	if assert.NotNil(u, id) {
+		version, _ := u.Version()
+		assert.Equal(uuid.Version(4), version)
+	}
+	another, _ := g.generate(Document{})
+	assert.NotEqual(id, another)
+
+	g = &IDGenerator{Type: "ulid"}
+	assert.NoError(g.compile())
+	id, err = g.generate(Document{})
+	assert.NoError(err)
+	_, err = ulid.Parse(id)
+	assert.NoError(err, id)
+
+	g = &IDGenerator{Type: "uuidv5", Namespace: uuid.NameSpace_URL.String(), Field: "source.ref"}
+	assert.NoError(g.compile())
+	id, err = g.generate(Document{"source": map[string]interface{}{"ref": "http://example.com/1"}})
+	assert.NoError(err)
+	assert.Equal(uuid.NewSHA1(uuid.NameSpace_URL, []byte("http://example.com/1")).String(), id)
+	for _, doc := range []Document{{}, {"source": map[string]interface{}{"ref": 1.0}}, {"source": map[string]interface{}{"ref": ""}}} {
+		_, err := g.generate(doc)
+		assert.Error(err, "%v", doc)
+	}
+
+	for _, g := range []*IDGenerator{
+		{Type: "uuidv6"},
+		{Type: "uuidv5", Namespace: "not a uuid", Field: "ref"},
+		{Type: "uuidv5", Namespace: uuid.NameSpace_URL.String()},
+	} {
+		assert.Error(g.compile(), g.Type)
+	}
+	_, err = idGenerators(map[string]CollectionSettings{"c": {IDGenerator: &IDGenerator{Type: "ulid"}}, "d": {}})
+	assert.NoError(err)
+	_, err = idGenerators(map[string]CollectionSettings{"c": {IDGenerator: &IDGenerator{Type: "uuidv5"}}})
+	assert.Error(err)
+}
+
+func TestCreateHandler(t *testing.T) {
+	nested := collectionSettings("nested", "meta.uuid")
+	templated := collectionSettings("templated", "{ref}")
+	templated.IDGenerator = &IDGenerator{Type: "uuidv5", Namespace: uuid.NameSpace_URL.String(), Field: "url"}
+	collections := map[string]CollectionSettings{"nested": nested, "templated": templated}
+	testWithAPI(t, collections, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		// the id is always under "id", whatever the id property
+		w := api.do("POST", "/nested/", `{"name":"one"}`)
+		assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+		var created map[string]string
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &created))
+		assert.NotNil(uuid.Parse(created["id"]), w.Body.String())
+		assert.Equal("/nested/"+created["id"], w.Header().Get("Location"))
+		w = api.do("GET", w.Header().Get("Location"), "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.JSONEq(`{"name":"one","meta":{"uuid":"`+created["id"]+`"}}`, w.Body.String())
+
+		w = api.do("POST", "/nested/", `{"meta":{"uuid":"1"}}`)
+		assert.Equal(http.StatusBadRequest, w.Code)
+
+		id := uuid.NewSHA1(uuid.NameSpace_URL, []byte("http://example.com/1")).String()
+		for i := 0; i < 2; i++ {
+			w = api.do("POST", "/templated/", `{"url":"http://example.com/1"}`)
+			assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+			assert.JSONEq(`{"id":"`+id+`"}`, w.Body.String())
+		}
+		w = api.do("GET", "/templated/"+id, "")
+		assert.JSONEq(`{"url":"http://example.com/1","ref":"`+id+`"}`, w.Body.String())
+
+		w = api.do("POST", "/templated/", `{"name":"no url"}`)
+		assert.Equal(http.StatusBadRequest, w.Code)
+	})
+}
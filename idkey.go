@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// idKey is how a collection's documents are identified. The simplest is a
+// property name, e.g. "uuid", whose string value is the id. A dotted path,
+// e.g. "meta.uuid", names a nested property. Otherwise it's a template giving
+// the url form of ids built from one or more properties, e.g.
+// "{authority}:{identifierValue}" or "{code:number}", where ":number" marks
+// numeric properties. The text between properties separates their values, so
+// values can't contain it.
+type idKey struct {
+	fields []idField
+	// literals[i] precedes fields[i], and the last follows the last field.
+	literals []string
+}
+
+type idField struct {
+	path   string
+	number bool
+}
+
+// idKeys caches parsed id keys by their spec, since they're used for every
+// document.
+var idKeys sync.Map
+
+// parseIDKey parses an id property name or template.
+func parseIDKey(spec string) (*idKey, error) {
+	if k, found := idKeys.Load(spec); found {
+		return k.(*idKey), nil
+	}
+	k, err := compileIDKey(spec)
+	if err != nil {
+		return nil, err
+	}
+	idKeys.Store(spec, k)
+	return k, nil
+}
+
+func compileIDKey(spec string) (*idKey, error) {
+	if spec == "" {
+		return nil, errors.New("empty id property")
+	}
+	if !strings.ContainsAny(spec, "{}") {
+		return &idKey{fields: []idField{{path: spec}}, literals: []string{"", ""}}, nil
+	}
+
+	k := &idKey{}
+	rest := spec
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		literal := rest[:open]
+		if len(k.fields) > 0 && literal == "" {
+			return nil, fmt.Errorf("id template %s has no separator between properties", spec)
+		}
+		k.literals = append(k.literals, literal)
+		end := strings.IndexByte(rest, '}')
+		if end < open {
+			return nil, fmt.Errorf("id template %s has unbalanced braces", spec)
+		}
+		field := idField{path: rest[open+1 : end]}
+		if strings.HasSuffix(field.path, ":number") {
+			field.path, field.number = strings.TrimSuffix(field.path, ":number"), true
+		}
+		if field.path == "" || strings.ContainsAny(field.path, "{:") {
+			return nil, fmt.Errorf("id template %s has an invalid property %s", spec, rest[open:end+1])
+		}
+		k.fields = append(k.fields, field)
+		rest = rest[end+1:]
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return nil, fmt.Errorf("id template %s has unbalanced braces", spec)
+	}
+	k.literals = append(k.literals, rest)
+	for _, literal := range k.literals {
+		if strings.ContainsAny(literal, "/?#") {
+			return nil, fmt.Errorf("id template %s can't be used in urls", spec)
+		}
+	}
+	return k, nil
+}
+
+// simple reports whether the id is the string value of a single property.
+func (k *idKey) simple() bool {
+	return len(k.fields) == 1 && !k.fields[0].number && k.literals[0] == "" && k.literals[1] == ""
+}
+
+// of returns the id of a document, and false if it doesn't have one.
+func (k *idKey) of(doc map[string]interface{}) (string, bool) {
+	var id strings.Builder
+	for i, field := range k.fields {
+		v, found := lookupPath(doc, field.path)
+		if !found {
+			return "", false
+		}
+		value, ok := formatIDValue(v, field.number)
+		if !ok || value == "" {
+			return "", false
+		}
+		if next := k.literals[i+1]; next != "" && strings.Contains(value, next) {
+			// the id couldn't be parsed back into its values
+			return "", false
+		}
+		id.WriteString(k.literals[i])
+		id.WriteString(value)
+	}
+	id.WriteString(k.literals[len(k.fields)])
+	return id.String(), true
+}
+
+func formatIDValue(v interface{}, number bool) (string, bool) {
+	if !number {
+		s, ok := v.(string)
+		return s, ok
+	}
+	switch n := v.(type) {
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64), true
+	case json.Number:
+		return n.String(), true
+	case int:
+		return strconv.Itoa(n), true
+	case int32:
+		return strconv.FormatInt(int64(n), 10), true
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	}
+	return "", false
+}
+
+// values parses an id into the values of its properties.
+func (k *idKey) values(id string) ([]interface{}, error) {
+	if !strings.HasPrefix(id, k.literals[0]) {
+		return nil, fmt.Errorf("id %s doesn't start with %s", id, k.literals[0])
+	}
+	rest := id[len(k.literals[0]):]
+	values := make([]interface{}, len(k.fields))
+	for i, field := range k.fields {
+		next := k.literals[i+1]
+		end := len(rest) - len(next)
+		if i < len(k.fields)-1 {
+			end = strings.Index(rest, next)
+		} else if !strings.HasSuffix(rest, next) {
+			end = -1
+		}
+		if end <= 0 {
+			return nil, fmt.Errorf("id %s doesn't match %s", id, k)
+		}
+		value := rest[:end]
+		rest = rest[end+len(next):]
+		if !field.number {
+			values[i] = value
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("id %s has %s %s, which isn't a number", id, field.path, value)
+		}
+		values[i] = n
+	}
+	return values, nil
+}
+
+// set sets the properties of a document that make up an id.
+func (k *idKey) set(doc map[string]interface{}, id string) error {
+	values, err := k.values(id)
+	if err != nil {
+		return err
+	}
+	for i, field := range k.fields {
+		setPath(doc, field.path, values[i])
+	}
+	return nil
+}
+
+func (k *idKey) String() string {
+	if k.simple() {
+		return k.fields[0].path
+	}
+	var s strings.Builder
+	for i, field := range k.fields {
+		s.WriteString(k.literals[i])
+		s.WriteString("{" + field.path)
+		if field.number {
+			s.WriteString(":number")
+		}
+		s.WriteString("}")
+	}
+	s.WriteString(k.literals[len(k.fields)])
+	return s.String()
+}
+
+// documentID returns the id of a document in a collection with the given id
+// property, and false if it doesn't have one.
+func documentID(idProperty string, doc map[string]interface{}) (string, bool) {
+	k, err := parseIDKey(idProperty)
+	if err != nil {
+		return "", false
+	}
+	return k.of(doc)
+}
+
+// setDocumentID sets the id of a document in a collection with the given id
+// property.
+func setDocumentID(idProperty string, doc map[string]interface{}, id string) error {
+	k, err := parseIDKey(idProperty)
+	if err != nil {
+		return err
+	}
+	return k.set(doc, id)
+}
+
+// hasDocumentID reports whether a document has any of the properties that make
+// up its id.
+func hasDocumentID(idProperty string, doc map[string]interface{}) bool {
+	k, err := parseIDKey(idProperty)
+	if err != nil {
+		return false
+	}
+	for _, field := range k.fields {
+		if _, found := lookupPath(doc, field.path); found {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+// Operations change the fields of a document in place, like mongodb's update
+// operators. Each maps dotted paths to values.
+type Operations struct {
+	// Inc adds numbers to numeric fields, setting missing ones.
+	Inc map[string]interface{} `json:"inc"`
+	// Push appends values to arrays, creating missing ones.
+	Push map[string]interface{} `json:"push"`
+	// AddToSet appends values to arrays unless they're already there.
+	AddToSet map[string]interface{} `json:"addToSet"`
+	// Pull removes every element equal to a value from arrays.
+	Pull map[string]interface{} `json:"pull"`
+	// SetOnInsert sets fields only if the document is created.
+	SetOnInsert map[string]interface{} `json:"setOnInsert"`
+}
+
+// errUpdateUnsupported is returned by Updaters that can't apply operations
+// natively with their current configuration.
+var errUpdateUnsupported = errors.New("engine can't apply operations natively")
+
+// byOperator returns the operations keyed by their name.
+func (ops *Operations) byOperator() map[string]map[string]interface{} {
+	return map[string]map[string]interface{}{
+		"inc":         ops.Inc,
+		"push":        ops.Push,
+		"addToSet":    ops.AddToSet,
+		"pull":        ops.Pull,
+		"setOnInsert": ops.SetOnInsert,
+	}
+}
+
+// touches reports whether any operation changes the top level field name, or
+// a field within it.
+func (ops *Operations) touches(name string) bool {
+	for _, fields := range ops.byOperator() {
+		for path := range fields {
+			if path == name || strings.HasPrefix(path, name+".") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check returns an error if the operations are empty, malformed, conflict
+// with each other or change the id.
+func (ops *Operations) check(idProperty string) error {
+	key, err := parseIDKey(idProperty)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for name, fields := range ops.byOperator() {
+		for path, value := range fields {
+			for _, segment := range strings.Split(path, ".") {
+				if segment == "" {
+					return fmt.Errorf("%s has an invalid path %q", name, path)
+				}
+			}
+			if _, ok := value.(float64); name == "inc" && !ok {
+				return fmt.Errorf("inc of %s by %v, which isn't a number", path, value)
+			}
+			for _, field := range key.fields {
+				if pathsOverlap(path, field.path) {
+					return fmt.Errorf("%s of %s would change the document's id", name, path)
+				}
+			}
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return errors.New("no operations")
+	}
+	sort.Strings(paths)
+	for i := 1; i < len(paths); i++ {
+		if pathsOverlap(paths[i-1], paths[i]) {
+			return fmt.Errorf("operations on %s and %s conflict", paths[i-1], paths[i])
+		}
+	}
+	return nil
+}
+
+// pathsOverlap reports whether two dotted paths are the same, or one is
+// within the other.
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+".") || strings.HasPrefix(b, a+".")
+}
+
+// apply changes a document, which is being created if created is true.
+func (ops *Operations) apply(doc Document, created bool) error {
+	if created {
+		for path, value := range ops.SetOnInsert {
+			setPath(doc, path, value)
+		}
+	}
+	for path, delta := range ops.Inc {
+		current, found := lookupPath(doc, path)
+		if !found {
+			setPath(doc, path, delta)
+			continue
+		}
+		n, ok := toFloat(current)
+		if !ok {
+			return fmt.Errorf("can't inc %s, which isn't a number", path)
+		}
+		setPath(doc, path, n+delta.(float64))
+	}
+	for path, value := range ops.Push {
+		arr, err := arrayAt(doc, path)
+		if err != nil {
+			return err
+		}
+		setPath(doc, path, append(arr, value))
+	}
+	for path, value := range ops.AddToSet {
+		arr, err := arrayAt(doc, path)
+		if err != nil {
+			return err
+		}
+		if !containsValue(arr, value) {
+			arr = append(arr, value)
+		}
+		setPath(doc, path, arr)
+	}
+	for path, value := range ops.Pull {
+		if _, found := lookupPath(doc, path); !found {
+			continue
+		}
+		arr, err := arrayAt(doc, path)
+		if err != nil {
+			return err
+		}
+		kept := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			if !valuesEqual(elem, value) {
+				kept = append(kept, elem)
+			}
+		}
+		setPath(doc, path, kept)
+	}
+	return nil
+}
+
+// arrayAt returns the array at a path, or an empty one if there's nothing
+// there.
+func arrayAt(doc Document, path string) ([]interface{}, error) {
+	current, found := lookupPath(doc, path)
+	if !found || current == nil {
+		return nil, nil
+	}
+	arr, ok := current.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s isn't an array", path)
+	}
+	return arr, nil
+}
+
+func containsValue(arr []interface{}, value interface{}) bool {
+	for _, elem := range arr {
+		if valuesEqual(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyedMutex serialises work on each of a set of keys, keeping a mutex only
+// for keys in use.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// lock locks a key, returning the function that unlocks it.
+func (km *keyedMutex) lock(key string) func() {
+	km.mu.Lock()
+	l, found := km.locks[key]
+	if !found {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	km.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		km.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(km.locks, key)
+		}
+		km.mu.Unlock()
+	}
+}
+
+// update applies operations to a document natively if the engine is an
+// Updater, and otherwise returns errUpdateUnsupported. Wrappers that are
+// Updaters forward to it.
+func update(coll Engine, id string, ops *Operations) (Document, bool, error) {
+	if u, ok := coll.(Updater); ok {
+		return u.Update(id, ops)
+	}
+	return nil, false, errUpdateUnsupported
+}
+
+// updateDocument applies operations to a document, creating it if it doesn't
+// exist. Engines that are Updaters apply them atomically, unless the
+// collection's documents must match a schema, which can only be checked
+// before writing. Otherwise the document is read, changed and written while
+// holding a lock on its id, which makes operations atomic with respect to
+// each other within this service, but not to other writes.
+func (ah *apiHandlers) updateDocument(name string, coll Engine, id string, ops *Operations) (Document, bool, error) {
+	if _, hasSchema := ah.schemas.get(name); !hasSchema {
+		doc, created, err := update(coll, id, ops)
+		if err != errUpdateUnsupported {
+			return doc, created, err
+		}
+	}
+
+	defer ah.locks.lock(name + "/" + id)()
+	read, found, err := coll.Read(id)
+	if err != nil {
+		return nil, false, err
+	}
+	doc := Document{}
+	if found {
+		doc = read.(Document)
+	} else if err := setDocumentID(coll.IDPropertyName(), doc, id); err != nil {
+		return nil, false, err
+	}
+	if err := ops.apply(doc, !found); err != nil {
+		return nil, false, &opsError{err}
+	}
+
+	decoded, _, err := decodeDocument(coll, doc)
+	if err != nil {
+		return nil, false, &opsError{err}
+	}
+	if err := ah.schemas.validate(name, id, decoded); err != nil {
+		return nil, false, err
+	}
+	if err := coll.Write(decoded); err != nil {
+		return nil, false, err
+	}
+	return decoded.(Document), !found, nil
+}
+
+// opsError is an error caused by operations that can't be applied to a
+// document, rather than by the engine.
+type opsError struct {
+	err error
+}
+
+func (oe *opsError) Error() string {
+	return oe.err.Error()
+}
+
+// opsHandler applies operations to a document, responding with the changed
+// document.
+func (ah *apiHandlers) opsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id, err := normaliseID(coll, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ops Operations
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&ops); err != nil {
+		http.Error(w, fmt.Sprintf("invalid operations: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := ops.check(coll.IDPropertyName()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	doc, created, err := ah.updateDocument(vars["collection"], coll, id, &ops)
+	switch e := err.(type) {
+	case nil:
+	case *validationError:
+		writeValidationError(w, e)
+		return
+	case *opsError:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if created {
+		w.Header().Add("Location", fmt.Sprintf("/%s/%s", vars["collection"], id))
+		writeDocumentStatus(w, r, doc, http.StatusCreated)
+		return
+	}
+	writeDocument(w, r, doc)
+}
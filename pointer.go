@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var errNoValue = errors.New("no value at pointer")
+
+// reservedPointerFields are top level fields whose paths are routed to other
+// handlers for some methods, so pointers into them are rejected for all.
+var reservedPointerFields = map[string]bool{"__redirect": true, "__aliases": true}
+
+// parsePointer splits an RFC 6901 JSON pointer into its reference tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %s doesn't start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		for j := 0; j < len(token); j++ {
+			if token[j] == '~' && (j == len(token)-1 || (token[j+1] != '0' && token[j+1] != '1')) {
+				return nil, fmt.Errorf("pointer %s has an invalid escape", pointer)
+			}
+		}
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// asObject returns a value as a map if it's a JSON object, however it was
+// decoded.
+func asObject(v interface{}) (map[string]interface{}, bool) {
+	switch o := v.(type) {
+	case map[string]interface{}:
+		return o, true
+	case Document:
+		return o, true
+	}
+	return nil, false
+}
+
+// arrayIndex returns the index of an array element referenced by a token.
+// "-", the element after the last, is only allowed if appending.
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if token == "-" && appending {
+		return length, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %s", token)
+	}
+	max := length - 1
+	if appending {
+		max = length
+	}
+	if i > max {
+		return 0, errNoValue
+	}
+	return i, nil
+}
+
+// pointerGet returns the value a pointer references.
+func pointerGet(v interface{}, tokens []string) (interface{}, error) {
+	for _, token := range tokens {
+		if o, ok := asObject(v); ok {
+			if v, ok = o[token]; !ok {
+				return nil, errNoValue
+			}
+			continue
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, errNoValue
+		}
+		i, err := arrayIndex(token, len(arr), false)
+		if err != nil {
+			return nil, err
+		}
+		v = arr[i]
+	}
+	return v, nil
+}
+
+// pointerSet sets the value a pointer references, returning the updated
+// container. The parent of the value must exist. Array elements are replaced,
+// or appended if the index is the array's length or "-".
+func pointerSet(v interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token := tokens[0]
+	if o, ok := asObject(v); ok {
+		if len(tokens) == 1 {
+			o[token] = value
+			return o, nil
+		}
+		child, found := o[token]
+		if !found {
+			return nil, errNoValue
+		}
+		child, err := pointerSet(child, tokens[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		o[token] = child
+		return o, nil
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errNoValue
+	}
+	i, err := arrayIndex(token, len(arr), len(tokens) == 1)
+	if err != nil {
+		return nil, err
+	}
+	if i == len(arr) {
+		return append(arr, value), nil
+	}
+	if arr[i], err = pointerSet(arr[i], tokens[1:], value); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+// pointerRemove removes the value a pointer references, returning the updated
+// container.
+func pointerRemove(v interface{}, tokens []string) (interface{}, error) {
+	token := tokens[0]
+	if o, ok := asObject(v); ok {
+		child, found := o[token]
+		if !found {
+			return nil, errNoValue
+		}
+		if len(tokens) == 1 {
+			delete(o, token)
+			return o, nil
+		}
+		child, err := pointerRemove(child, tokens[1:])
+		if err != nil {
+			return nil, err
+		}
+		o[token] = child
+		return o, nil
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, errNoValue
+	}
+	i, err := arrayIndex(token, len(arr), false)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return append(arr[:i:i], arr[i+1:]...), nil
+	}
+	if arr[i], err = pointerRemove(arr[i], tokens[1:]); err != nil {
+		return nil, err
+	}
+	return arr, nil
+}
+
+// readPointerDocument reads the document and parses the pointer of a sub
+// document request, responding with an error and returning false if either
+// fails.
+func (ah *apiHandlers) readPointerDocument(w http.ResponseWriter, r *http.Request) (Engine, string, Document, []string, bool) {
+	vars := mux.Vars(r)
+	coll, err := ah.getCollection(vars["collection"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", nil, nil, false
+	}
+	id, err := normaliseID(coll, vars["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", nil, nil, false
+	}
+	tokens, err := parsePointer("/" + vars["pointer"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", nil, nil, false
+	}
+	if reservedPointerFields[tokens[0]] {
+		http.Error(w, fmt.Sprintf("%s can't be read or changed by pointer", tokens[0]), http.StatusBadRequest)
+		return nil, "", nil, nil, false
+	}
+
+	doc, found, err := coll.Read(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, "", nil, nil, false
+	}
+	if !found {
+		http.Error(w, fmt.Sprintf("document with id %s was not found", id), http.StatusNotFound)
+		return nil, "", nil, nil, false
+	}
+	return coll, id, doc.(Document), tokens, true
+}
+
+// pointerReadHandler responds with the value at a JSON pointer within a
+// document, e.g. /people/{uuid}/aliases/0.
+func (ah *apiHandlers) pointerReadHandler(w http.ResponseWriter, r *http.Request) {
+	_, _, doc, tokens, ok := ah.readPointerDocument(w, r)
+	if !ok {
+		return
+	}
+	value, err := pointerGet(doc, tokens)
+	if err != nil {
+		writePointerError(w, err)
+		return
+	}
+	writeDocument(w, r, value)
+}
+
+// pointerWriteHandler sets the value at a JSON pointer within a document. The
+// document is read, changed and written whole, so a concurrent write to the
+// same document may be lost.
+func (ah *apiHandlers) pointerWriteHandler(w http.ResponseWriter, r *http.Request) {
+	coll, id, doc, tokens, ok := ah.readPointerDocument(w, r)
+	if !ok {
+		return
+	}
+	body, mediaType, err := requestBody(r)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if mediaType != mediaTypeJSON {
+		http.Error(w, fmt.Sprintf("unsupported content type %s", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	var value interface{}
+	if err := json.NewDecoder(body).Decode(&value); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	updated, err := pointerSet(doc, tokens, value)
+	if err != nil {
+		writePointerError(w, err)
+		return
+	}
+	ah.writePointerDocument(w, r, coll, id, updated)
+}
+
+// pointerDeleteHandler removes the value at a JSON pointer within a document.
+func (ah *apiHandlers) pointerDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	coll, id, doc, tokens, ok := ah.readPointerDocument(w, r)
+	if !ok {
+		return
+	}
+	updated, err := pointerRemove(doc, tokens)
+	if err != nil {
+		writePointerError(w, err)
+		return
+	}
+	ah.writePointerDocument(w, r, coll, id, updated)
+}
+
+// writePointerDocument writes a document changed by a sub document request,
+// decoding and validating it as if it had been PUT whole.
+func (ah *apiHandlers) writePointerDocument(w http.ResponseWriter, r *http.Request, coll Engine, id string, updated interface{}) {
+	doc, ok := asObject(updated)
+	if !ok {
+		http.Error(w, "documents must be objects", http.StatusBadRequest)
+		return
+	}
+	decoded, docID, err := decodeDocument(coll, doc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if docID != id {
+		http.Error(w, "the document's id can't be changed", http.StatusBadRequest)
+		return
+	}
+	if err := ah.schemas.validate(mux.Vars(r)["collection"], id, decoded); err != nil {
+		if ve, ok := err.(*validationError); ok {
+			writeValidationError(w, ve)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := coll.Write(decoded); err != nil {
+		http.Error(w, fmt.Sprintf("write failed:\n%v\n", err), http.StatusInternalServerError)
+	}
+}
+
+func writePointerError(w http.ResponseWriter, err error) {
+	if err == errNoValue {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
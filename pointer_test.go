@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPointerHandlers(t *testing.T) {
+	c := collectionSettings("c", "id")
+	c.Redirects = "redirect"
+	testWithAPI(t, map[string]CollectionSettings{"c": c}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/1", `{"id":"1","aliases":["a"],"__aliases":["b"]}`).Code)
+
+		w := api.do("GET", "/c/1/aliases/0", "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.JSONEq(`"a"`, w.Body.String())
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/1/aliases/-", `"c"`).Code)
+		assert.Equal(http.StatusOK, api.do("DELETE", "/c/1/aliases/0", "").Code)
+		assert.JSONEq(`["c"]`, api.do("GET", "/c/1/aliases", "").Body.String())
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/2/aliases", "").Code)
+
+		// fields with the names of the redirect routes can't be reached by
+		// any method
+		w = api.do("GET", "/c/1/__aliases", "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.JSONEq(`[]`, w.Body.String())
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			for _, path := range []string{"/c/1/__aliases/0", "/c/1/__redirect/to"} {
+				assert.Equal(http.StatusBadRequest, api.do(method, path, `"x"`).Code, method+" "+path)
+			}
+		}
+		assert.Equal(http.StatusBadRequest, api.do("PUT", "/c/1/__aliases", `[]`).Code)
+		assert.Equal(http.StatusBadRequest, api.do("DELETE", "/c/1/__aliases", "").Code)
+		assert.JSONEq(`{"id":"1","aliases":["c"],"__aliases":["b"]}`, api.do("GET", "/c/1", "").Body.String())
+	})
+}
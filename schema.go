@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// schemaRegistry holds the JSON schema, if any, that each collection's
+// documents must match.
+type schemaRegistry struct {
+	sync.RWMutex
+	schemas map[string]*gojsonschema.Schema
+	sources map[string]json.RawMessage
+}
+
+// newSchemaRegistry compiles the schemas in the collections' settings.
+func newSchemaRegistry(collections map[string]CollectionSettings) (*schemaRegistry, error) {
+	sr := &schemaRegistry{
+		schemas: make(map[string]*gojsonschema.Schema),
+		sources: make(map[string]json.RawMessage),
+	}
+	for name, c := range collections {
+		if len(c.Schema) == 0 {
+			continue
+		}
+		if err := sr.set(name, c.Schema); err != nil {
+			return nil, fmt.Errorf("invalid schema for %s: %v", name, err)
+		}
+	}
+	return sr, nil
+}
+
+func (sr *schemaRegistry) set(name string, source json.RawMessage) error {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(source))
+	if err != nil {
+		return err
+	}
+	sr.Lock()
+	defer sr.Unlock()
+	sr.schemas[name] = schema
+	sr.sources[name] = source
+	return nil
+}
+
+func (sr *schemaRegistry) get(name string) (json.RawMessage, bool) {
+	sr.RLock()
+	defer sr.RUnlock()
+	source, found := sr.sources[name]
+	return source, found
+}
+
+func (sr *schemaRegistry) remove(name string) bool {
+	sr.Lock()
+	defer sr.Unlock()
+	_, found := sr.schemas[name]
+	delete(sr.schemas, name)
+	delete(sr.sources, name)
+	return found
+}
+
+// validate checks a document against its collection's schema, returning a
+// *validationError if it doesn't match. Documents in collections without a
+// schema are always valid.
+func (sr *schemaRegistry) validate(name string, id string, doc interface{}) error {
+	sr.RLock()
+	schema, found := sr.schemas[name]
+	sr.RUnlock()
+	if !found {
+		return nil
+	}
+
+	result, err := schema.Validate(gojsonschema.NewGoLoader(doc))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	ve := &validationError{ID: id}
+	for _, re := range result.Errors() {
+		ve.Errors = append(ve.Errors, fieldError{Field: re.Field(), Description: re.Description()})
+	}
+	return ve
+}
+
+// validateBody checks every document in a request's body against the
+// collection's schema, so that none are written if any is invalid. The body is
+// staged in a temporary file and rewound for the documents to be decoded
+// again; the returned function removes it. Documents after one that can't be
+// decoded aren't checked, since writing stops there too.
+func (ah *apiHandlers) validateBody(name string, coll Engine, r *http.Request) (func(), error) {
+	staged, err := ioutil.TempFile("", "restorage-put")
+	if err != nil {
+		return func() {}, err
+	}
+	cleanup := func() {
+		staged.Close()
+		os.Remove(staged.Name())
+	}
+	if _, err := io.Copy(staged, r.Body); err != nil {
+		return cleanup, err
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return cleanup, err
+	}
+	r.Body = staged
+	dec, err := newRequestDecoder(r)
+	if err != nil {
+		return cleanup, err
+	}
+	for {
+		doc, id, err := dec.Decode(coll)
+		if err != nil {
+			break
+		}
+		if err := ah.schemas.validate(name, id, doc); err != nil {
+			return cleanup, err
+		}
+	}
+
+	if _, err := staged.Seek(0, io.SeekStart); err != nil {
+		return cleanup, err
+	}
+	r.Body = ioutil.NopCloser(staged)
+	return cleanup, nil
+}
+
+// validationError describes why a document doesn't match its collection's
+// schema.
+type validationError struct {
+	ID     string       `json:"id"`
+	Errors []fieldError `json:"errors"`
+}
+
+type fieldError struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+func (ve *validationError) Error() string {
+	return fmt.Sprintf("document %s doesn't match the collection's schema: %s %s", ve.ID, ve.Errors[0].Field, ve.Errors[0].Description)
+}
+
+func writeValidationError(w http.ResponseWriter, ve *validationError) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(ve)
+}
+
+func (ah *apiHandlers) schemaReadHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["collection"]
+	if _, err := ah.getCollection(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	source, found := ah.schemas.get(name)
+	if !found {
+		http.Error(w, fmt.Sprintf("collection %s has no schema", name), http.StatusNotFound)
+		return
+	}
+	w.Header().Add("Content-Type", "application/schema+json")
+	w.Write(source)
+}
+
+// schemaWriteHandler sets the schema for a collection. Schemas set this way
+// are only held in memory, so they're lost when the service restarts and
+// aren't seen by other instances; configure them in the collections config
+// to keep them.
+func (ah *apiHandlers) schemaWriteHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["collection"]
+	if _, err := ah.getCollection(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	source, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ah.schemas.set(name, source); err != nil {
+		http.Error(w, fmt.Sprintf("invalid schema: %v", err), http.StatusBadRequest)
+		return
+	}
+}
+
+func (ah *apiHandlers) schemaDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["collection"]
+	if !ah.schemas.remove(name) {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testSchema = `{"type":"object","required":["name"],"properties":{"n":{"type":"number"}}}`
+
+func TestSchemaHandlers(t *testing.T) {
+	testWithAPI(t, map[string]CollectionSettings{"c": collectionSettings("c", "id")}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		assert.Equal(http.StatusNotFound, api.do("GET", "/__collections/c/schema", "").Code)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/__collections/missing/schema", "").Code)
+		assert.Equal(http.StatusNotFound, api.do("PUT", "/__collections/missing/schema", testSchema).Code)
+		assert.Equal(http.StatusBadRequest, api.do("PUT", "/__collections/c/schema", `{"type":`).Code)
+		assert.Equal(http.StatusBadRequest, api.do("PUT", "/__collections/c/schema", `{"type":"nothing"}`).Code)
+
+		assert.Equal(http.StatusOK, api.do("PUT", "/__collections/c/schema", testSchema).Code)
+		w := api.do("GET", "/__collections/c/schema", "")
+		assert.Equal(http.StatusOK, w.Code)
+		assert.Equal("application/schema+json", w.Header().Get("Content-Type"))
+		assert.JSONEq(testSchema, w.Body.String())
+
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/1", `{"id":"1","name":"one"}`).Code)
+		w = api.do("PUT", "/c/2", `{"id":"2","n":"two"}`)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		var ve validationError
+		assert.NoError(json.Unmarshal(w.Body.Bytes(), &ve))
+		assert.Equal("2", ve.ID)
+		assert.Len(ve.Errors, 2)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/2", "").Code)
+
+		assert.Equal(http.StatusOK, api.do("DELETE", "/__collections/c/schema", "").Code)
+		assert.Equal(http.StatusNotFound, api.do("DELETE", "/__collections/c/schema", "").Code)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/__collections/c/schema", "").Code)
+		assert.Equal(http.StatusOK, api.do("PUT", "/c/2", `{"id":"2","n":"two"}`).Code)
+	})
+}
+
+func TestSchemaValidation(t *testing.T) {
+	c := collectionSettings("c", "id")
+	c.Schema = json.RawMessage(testSchema)
+	testWithAPI(t, map[string]CollectionSettings{"c": c}, func(t *testing.T, api *testAPI) {
+		assert := assert.New(t)
+
+		// nothing in a whole collection is written if any document is invalid
+		w := api.do("PUT", "/c/", `{"id":"1","name":"one"}`+"\n"+`{"id":"2"}`+"\n"+`{"id":"3","name":"three"}`)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(w.Body.String(), `"id":"2"`)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/1", "").Code)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/3", "").Code)
+		w = api.do("PUT", "/c/", string(gzipped(t, []byte(`{"id":"1","name":"one"}`+"\n"+`{"id":"3","name":"three"}`))), "Content-Encoding", "gzip")
+		assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(http.StatusOK, api.do("GET", "/c/3", "").Code)
+
+		// nothing in a batch is applied if any document is invalid
+		w = api.do("POST", "/__batch", `{"operations":[
+			{"op":"put","collection":"c","document":{"id":"4","name":"four"}},
+			{"op":"delete","collection":"c","id":"1"},
+			{"op":"put","collection":"c","document":{"id":"5","n":5}}
+		]}`)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		assert.Contains(w.Body.String(), `"id":"5"`)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/4", "").Code)
+		assert.Equal(http.StatusOK, api.do("GET", "/c/1", "").Code)
+
+		// operations are checked before the changed document is written
+		w = api.do("POST", "/c/6/__ops", `{"inc":{"n":1}}`)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code)
+		assert.Equal(http.StatusNotFound, api.do("GET", "/c/6", "").Code)
+		w = api.do("POST", "/c/6/__ops", `{"inc":{"n":1},"setOnInsert":{"name":"six"}}`)
+		assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+		assert.JSONEq(`{"id":"6","n":1,"name":"six"}`, w.Body.String())
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ugorji/go/codec"
+)
+
+// storageCodec serialises documents for engines that store raw bytes.
+type storageCodec interface {
+	Name() string
+	Marshal(doc Document) ([]byte, error)
+	Unmarshal(data []byte) (Document, error)
+}
+
+var storageCodecs = map[string]storageCodec{
+	"gob":     gobCodec{},
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+func init() {
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+}
+
+func getStorageCodec(name string) (storageCodec, error) {
+	c, ok := storageCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %s", name)
+	}
+	return c, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string {
+	return "gob"
+}
+
+func (gobCodec) Marshal(doc Document) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(doc); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte) (Document, error) {
+	var doc Document
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Marshal(doc Document) ([]byte, error) {
+	return json.Marshal(doc)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (Document, error) {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Marshal(doc Document) ([]byte, error) {
+	var data []byte
+	if err := codec.NewEncoderBytes(&data, binaryHandles[mediaTypeMsgpack]).Encode(map[string]interface{}(doc)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte) (Document, error) {
+	var doc map[string]interface{}
+	if err := codec.NewDecoderBytes(data, binaryHandles[mediaTypeMsgpack]).Decode(&doc); err != nil {
+		return nil, err
+	}
+	return Document(doc), nil
+}